@@ -0,0 +1,144 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"sync/atomic"
+)
+
+// The writes of a node, and of an item's tag hash, run as server-side scripts, so a crash in the middle of one never
+// leaves an item in the base set but missing from the ranks, or an item without its tag hash.
+// With all the keys of the index on one server (one shard, no RedisCluster), the basic nodes of an item & its tags are
+// written by one script, so an item is in all the nodes of its tags & the tags are its current ones, or none of it.
+// The high nodes & the combinations aren't in it, they're decided on what's read after: a crash leaves some of them
+// behind, Update the item again to repair. With the keys spread over the shards or the cluster slots, it's per node.
+// The servers without scripting (eg: an in-memory stand-in, or a proxy rejecting EVAL) fall back to the pipelines.
+var (
+	// KEYS: base set, score rank, date rank, overall rank. ARGV: id, score, date, overall score.
+	attachScript = redis.NewScript(4, `
+redis.call("SADD", KEYS[1], ARGV[1])
+redis.call("ZADD", KEYS[2], ARGV[2], ARGV[1])
+redis.call("ZADD", KEYS[3], ARGV[3], ARGV[1])
+redis.call("ZADD", KEYS[4], ARGV[4], ARGV[1])
+return 1
+`)
+
+	// KEYS: base set, score rank, date rank, overall rank. ARGV: id.
+	detachScript = redis.NewScript(4, `
+redis.call("SREM", KEYS[1], ARGV[1])
+redis.call("ZREM", KEYS[2], ARGV[1])
+redis.call("ZREM", KEYS[3], ARGV[1])
+redis.call("ZREM", KEYS[4], ARGV[1])
+return 1
+`)
+
+	// KEYS: item tag hash. ARGV: title, aliases, title, aliases ...
+	itemTagInfosScript = redis.NewScript(1, `
+redis.call("DEL", KEYS[1])
+for i = 1, #ARGV, 2 do
+	redis.call("HSET", KEYS[1], ARGV[i], ARGV[i + 1])
+end
+return 1
+`)
+
+	// KEYS: item tag hash, then the base set & the ranks of each node to detach from, then of each to attach to.
+	// ARGV: id, score, date, the nodes to detach from, the nodes to attach to, 1 to set the item tags,
+	// the overall score of each node to attach to, then title, aliases, title, aliases ...
+	itemScript = redis.NewScript(-1, `
+local id, score, date = ARGV[1], ARGV[2], ARGV[3]
+local detaching, attaching = tonumber(ARGV[4]), tonumber(ARGV[5])
+local k = 2
+for i = 1, detaching do
+	redis.call("SREM", KEYS[k], id)
+	redis.call("ZREM", KEYS[k + 1], id)
+	redis.call("ZREM", KEYS[k + 2], id)
+	redis.call("ZREM", KEYS[k + 3], id)
+	k = k + 4
+end
+for i = 1, attaching do
+	redis.call("SADD", KEYS[k], id)
+	redis.call("ZADD", KEYS[k + 1], score, id)
+	redis.call("ZADD", KEYS[k + 2], date, id)
+	redis.call("ZADD", KEYS[k + 3], ARGV[6 + i], id)
+	k = k + 4
+end
+if ARGV[6] == "1" then
+	redis.call("DEL", KEYS[1])
+	for i = 7 + attaching, #ARGV, 2 do
+		redis.call("HSET", KEYS[1], ARGV[i], ARGV[i + 1])
+	end
+end
+return 1
+`)
+)
+
+// all the keys of the index on one server, the keys of an item & of its nodes can go in one script.
+func (idx *Index) colocated() bool {
+	return !idx.cluster() && idx.shardCount() == 1
+}
+
+// detach the item from the nodes, attach it to the others & set its tags if set_tags, in one script.
+// False if there's no scripting, the caller writes them one by one.
+func (idx *Index) writeItem(item Item, detaching []*index_node, attaching [][]*index_node, infos []*taginfo, set_tags bool) bool {
+	item_id, item_score, item_date := item.Id(), item.Score(), item.CreateDate()
+
+	keys := []interface{}{idx.itemKey(const_key_item_tag_hash, item_id)}
+	for _, n := range detaching {
+		keys = append(keys, n.rankKeys()...)
+	}
+	scores := make([]interface{}, 0, len(attaching))
+	for _, nodes := range attaching {
+		for _, n := range nodes {
+			keys = append(keys, n.rankKeys()...)
+			scores = append(scores, fade_score(item_score*n.tags_score, item_date))
+		}
+	}
+
+	flag := 0
+	if set_tags {
+		flag = 1
+	}
+	args := append([]interface{}{len(keys)}, keys...)
+	args = append(args, item_id, item_score, item_date, len(detaching), len(scores), flag)
+	args = append(args, scores...)
+	for _, info := range infos {
+		args = append(args, info.title, joinTags(info.aliases, const_tags_separator))
+	}
+
+	c := idx.writeConn(idx.id2shard(item_id))
+	defer c.Close()
+	return idx.runScript(c, itemScript, args...)
+}
+
+// the keys of the base set & the ranks, as the script KEYS.
+func (node *index_node) rankKeys() []interface{} {
+	return []interface{}{
+		node.idstr(const_key_idx_base_set),
+		node.idstr(const_key_idx_score_rank),
+		node.idstr(const_key_idx_date_rank),
+		node.idstr(const_key_idx_overall_rank),
+	}
+}
+
+// run the script, false if there's no scripting & the caller should fall back.
+func (idx *Index) runScript(c redis.Conn, script *redis.Script, keysAndArgs ...interface{}) bool {
+	if atomic.LoadInt32(&idx.scriptingUnsupported) == 1 {
+		return false
+	}
+	_, err := script.Do(c, keysAndArgs...)
+	if err == nil {
+		return true
+	}
+	if isScriptingUnsupported(err) {
+		idx.logger().Println("No scripting on the server, falling back to pipelines:", idx.What, err)
+		atomic.StoreInt32(&idx.scriptingUnsupported, 1)
+		return false
+	}
+	idx.logger().Panicln(err)
+	return false
+}
+
+func isScriptingUnsupported(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unknown command") || strings.Contains(msg, "not supported") || strings.Contains(msg, "disabled")
+}
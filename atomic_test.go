@@ -0,0 +1,108 @@
+package tagstack
+
+import (
+	"bytes"
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestIsScriptingUnsupported(t *testing.T) {
+	must(isScriptingUnsupported(errors.New("ERR unknown command 'EVALSHA'")), "unknown command")
+	must(!isScriptingUnsupported(errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")), "wrong type")
+}
+
+// a connection recording the commands, the scripts are answered by scriptErr if set.
+type scriptConn struct {
+	scriptErr error
+	cmds      []string
+	args      []interface{}
+	pending   int
+}
+
+func (c *scriptConn) Close() error { return nil }
+func (c *scriptConn) Err() error   { return nil }
+func (c *scriptConn) Flush() error { return nil }
+func (c *scriptConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.cmds, c.args = append(c.cmds, cmd), args
+	switch {
+	case c.scriptErr != nil && strings.HasPrefix(cmd, "EVAL"):
+		return nil, c.scriptErr
+	case cmd == "EVALSHA":
+		return nil, redis.Error("NOSCRIPT No matching script.")
+	}
+	return int64(1), nil
+}
+func (c *scriptConn) Send(cmd string, args ...interface{}) error {
+	c.cmds = append(c.cmds, cmd)
+	c.pending++
+	return nil
+}
+func (c *scriptConn) Receive() (interface{}, error) {
+	c.pending--
+	return int64(1), nil
+}
+
+func TestRunScript(t *testing.T) {
+	c := &scriptConn{}
+	index := &Index{What: "t.", GetWriteConn: func(int) redis.Conn { return c }, Logger: log.New(ioutil.Discard, "", 0)}
+	n := newIndexNode(index, []string{"A"}, 1.0)
+	item := &testItem{id: 1, score: 1}
+
+	// the script is loaded on NOSCRIPT.
+	n.attach(item)
+	must(strings.Join(c.cmds, " ") == "EVALSHA EVAL", "script:", c.cmds)
+
+	// no scripting: the pipeline, and the script isn't tried again.
+	c.cmds, c.scriptErr = nil, redis.Error("ERR unknown command 'EVALSHA'")
+	n.detach(item)
+	must(strings.Join(c.cmds, " ") == "EVALSHA SREM ZREM ZREM ZREM" && c.pending == 0, "fallback:", c.cmds)
+	c.cmds = nil
+	n.attach(item)
+	must(strings.Join(c.cmds, " ") == "SADD ZADD ZADD ZADD" && c.pending == 0, "fallback:", c.cmds)
+	must(index.scriptingUnsupported == 1 && (&Index{}).scriptingUnsupported == 0, "the flag is per index")
+
+	// the other errors aren't swallowed.
+	c.cmds, c.scriptErr = nil, redis.Error("CROSSSLOT Keys in request don't hash to the same slot")
+	panicked := func() (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		(&Index{What: "t.", Logger: index.Logger}).runScript(c, detachScript, n.rankKeys()...)
+		return
+	}()
+	must(panicked, "CROSSSLOT should panic")
+}
+
+func TestWriteItem(t *testing.T) {
+	c := &scriptConn{}
+	index := &Index{What: "t.", GetWriteConn: func(int) redis.Conn { return c }, Logger: log.New(ioutil.Discard, "", 0), RedisShardMax: 1}
+	must(index.colocated(), "one shard")
+	must(!(&Index{RedisShardMax: 2}).colocated() && !(&Index{RedisShardMax: 1, RedisCluster: true}).colocated(), "spread")
+
+	item := &testItem{id: 1, score: 1}
+	detaching := []*index_node{newIndexNode(index, []string{"A"}, 1.0)}
+	attaching := [][]*index_node{{newIndexNode(index, []string{"B"}, 1.0), newIndexNode(index, []string{"C"}, 0.5)}}
+	infos := []*taginfo{{title: "B", aliases: []string{"C"}}}
+
+	// the tag hash & 3 nodes as KEYS, then id, score, date, 1 to detach from, 2 to attach to, the flag, 2 scores, 1 tag.
+	must(index.writeItem(item, detaching, attaching, infos, true), "written")
+	must(strings.Join(c.cmds, " ") == "EVALSHA EVAL", "script:", c.cmds)
+	must(len(c.args) == 2+13+6+2+2 && c.args[1] == 13 && c.args[2] == "tith.1", "args:", c.args)
+
+	// no scripting: the caller writes them.
+	c.cmds, c.scriptErr = nil, redis.Error("ERR unknown command 'EVALSHA'")
+	must(!index.writeItem(item, detaching, nil, nil, false), "fallback")
+}
+
+func TestIndexAst(t *testing.T) {
+	buf := &bytes.Buffer{}
+	index := &Index{Logger: log.New(buf, "", 0)}
+	panicked := func() (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		index.ast2(nil, redis.Error("ERR boom"))
+		return
+	}()
+	must(panicked && strings.Contains(buf.String(), "ERR boom"), "the index logger:", buf.String())
+}
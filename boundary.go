@@ -0,0 +1,147 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// the query count of each tag, for AdaptiveHighNodeBoundary.
+	const_key_tag_query_count = "tqct."
+
+	// the queries halving the boundary of a tag, see adaptBoundary.
+	const_adaptive_query_unit = 1000
+	// the lowest boundary the adaptive mode makes.
+	const_adaptive_min_boundary = 3
+)
+
+// The boundary of a node to become high: the lowest boundary of its tags.
+func (idx *Index) highBoundary(n *index_node) int {
+	if len(n.tags) == 0 {
+		return idx.HighNodeBoundary
+	}
+
+	var queries []float64
+	if idx.AdaptiveHighNodeBoundary {
+		queries = idx.tagQueryCounts(n.tags)
+	}
+
+	boundary := 0
+	for i, tag := range n.tags {
+		b := idx.HighNodeBoundary
+		if override, ok := idx.TagHighNodeBoundaries[tag]; ok {
+			b = override
+		}
+		if queries != nil {
+			b = adaptBoundary(b, queries[i])
+		}
+		if boundary == 0 || b < boundary {
+			boundary = b
+		}
+	}
+	return boundary
+}
+
+// The boundary of a high node to be demoted, in the same ratio as HighNodeLowBoundary to HighNodeBoundary.
+func (idx *Index) lowBoundary(n *index_node) int {
+	high := idx.highBoundary(n)
+	if idx.HighNodeLowBoundary > 0 {
+		return high * idx.HighNodeLowBoundary / idx.HighNodeBoundary
+	}
+	return high / 2
+}
+
+// a hot tag branches early: the boundary shrinks harmonically with the queries, as B * U / (U + queries)
+// with U = const_adaptive_query_unit: to 1/2 at U queries, 1/3 at 2U, 1/(k+1) at kU.
+func adaptBoundary(boundary int, queries float64) int {
+	if boundary <= const_adaptive_min_boundary {
+		return boundary
+	}
+	adapted := int(float64(boundary) * const_adaptive_query_unit / (const_adaptive_query_unit + queries))
+	if adapted < const_adaptive_min_boundary {
+		return const_adaptive_min_boundary
+	}
+	return adapted
+}
+
+func (idx *Index) tagQueryShard() int {
+	return idx.str2shard(idx.What + const_key_tag_query_count)
+}
+
+// count the queries of the tags, for AdaptiveHighNodeBoundary.
+func (idx *Index) recordQuery(tags []string) {
+	if !idx.AdaptiveHighNodeBoundary || len(tags) == 0 {
+		return
+	}
+	c := idx.writeConn(idx.tagQueryShard())
+	defer c.Close()
+	for _, tag := range tags {
+		c.Send("ZINCRBY", idx.What+const_key_tag_query_count, 1, tag)
+	}
+	c.Flush()
+	for range tags {
+		idx.ast2(c.Receive())
+	}
+}
+
+// the query counts of the tags as of the last RebalanceHighNodes, loaded once before the first one.
+func (idx *Index) tagQueryCounts(tags []string) []float64 {
+	idx.queryCountsLock.RLock()
+	all := idx.queryCounts
+	idx.queryCountsLock.RUnlock()
+	if all == nil {
+		all = idx.loadQueryCounts()
+	}
+
+	counts := make([]float64, len(tags))
+	for i, tag := range tags {
+		counts[i] = all[tag]
+	}
+	return counts
+}
+
+// load the query counts, the halving leaves fractions, below 1 they're too few to count.
+func (idx *Index) loadQueryCounts() map[string]float64 {
+	c := idx.primaryConn(idx.tagQueryShard())
+	vals, _ := redis.Values(idx.ast2(c.Do("ZRANGEBYSCORE", idx.What+const_key_tag_query_count, 1, "+inf", "WITHSCORES")))
+	c.Close()
+
+	counts := make(map[string]float64, len(vals)/2)
+	for i := 0; i < len(vals); i += 2 {
+		tag, _ := redis.String(vals[i], nil)
+		counts[tag], _ = redis.Float64(vals[i+1], nil)
+	}
+
+	idx.queryCountsLock.Lock()
+	idx.queryCounts = counts
+	idx.queryCountsLock.Unlock()
+	return counts
+}
+
+// Promote & demote the basic nodes whose effective boundaries have changed, eg: after TagHighNodeBoundaries is edited,
+// or periodically with AdaptiveHighNodeBoundary. The items of a promoted node are reindexed to build the combinations.
+// The query counts are halved each time, so the adaptive boundaries follow the recent traffic.
+func (index *Index) RebalanceHighNodes() (promoted, demoted int) {
+	if index.AdaptiveHighNodeBoundary {
+		index.loadQueryCounts()
+	}
+	demoted = index.CollectGarbage()
+
+	c := index.primaryConn(index.tagDictShard())
+	tags, _ := redis.Strings(index.ast2(c.Do("ZRANGEBYSCORE", index.tagDictKey(const_key_tag_dict_count), const_adaptive_min_boundary, "+inf")))
+	c.Close()
+
+	for _, tag := range tags {
+		if n := newIndexNode(index, []string{tag}, 1.0); index.promotionTest(n) {
+			index.rebuildCombinations(n)
+			promoted++
+		}
+	}
+
+	if index.AdaptiveHighNodeBoundary {
+		key := index.What + const_key_tag_query_count
+		c := index.writeConn(index.tagQueryShard())
+		index.ast2(c.Do("ZUNIONSTORE", key, 1, key, "WEIGHTS", 0.5))
+		c.Close()
+	}
+	return
+}
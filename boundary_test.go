@@ -0,0 +1,27 @@
+package tagstack
+
+import (
+	"testing"
+)
+
+func TestAdaptBoundary(t *testing.T) {
+	must(adaptBoundary(100, 0) == 100, "no queries")
+	must(adaptBoundary(100, const_adaptive_query_unit) == 50, "halved")
+	must(adaptBoundary(100, 2*const_adaptive_query_unit) == 33, "a third")
+	must(adaptBoundary(100, 1000*const_adaptive_query_unit) == const_adaptive_min_boundary, "the lowest")
+	must(adaptBoundary(2, 1000) == 2, "below the lowest")
+}
+
+func TestHighBoundary(t *testing.T) {
+	index := &Index{HighNodeBoundary: 100, HighNodeLowBoundary: 20, TagHighNodeBoundaries: map[string]int{"美食": 10, "冷门": 1000}}
+	must(index.highBoundary(newIndexNode(index, []string{"A"}, 1.0)) == 100, "default")
+	must(index.highBoundary(newIndexNode(index, []string{"冷门"}, 1.0)) == 1000, "niche")
+	must(index.highBoundary(newIndexNode(index, []string{"冷门", "美食"}, 1.0)) == 10, "the lowest of the tags")
+	must(index.lowBoundary(newIndexNode(index, []string{"美食"}, 1.0)) == 2, "low boundary")
+
+	// the query counts are fractional after halving.
+	index.AdaptiveHighNodeBoundary = true
+	index.queryCounts = map[string]float64{"热门": 1500.5}
+	must(index.highBoundary(newIndexNode(index, []string{"热门"}, 1.0)) == 39, "adaptive:", index.highBoundary(newIndexNode(index, []string{"热门"}, 1.0)))
+	must(index.highBoundary(newIndexNode(index, []string{"A"}, 1.0)) == 100, "no queries")
+}
@@ -0,0 +1,47 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+)
+
+// With RedisCluster, the part of a key deciding where it's placed is wrapped as a hash tag, so the keys used together
+// are in one slot: the keys of a node, of an item, of a tag in the registry, and the tag dictionary.
+func (idx *Index) hashTag(s string) string {
+	if idx.cluster() {
+		return "{" + s + "}"
+	}
+	return s
+}
+
+// the hash tag appended to the index-wide keys used together, nothing without RedisCluster.
+func (idx *Index) clusterTag(s string) string {
+	if idx.cluster() {
+		return "{" + s + "}"
+	}
+	return ""
+}
+
+// the key of an item record.
+func (idx *Index) itemKey(prefix string, id uint64) string {
+	return prefix + idx.hashTag(strconv.FormatUint(id, 10))
+}
+
+// the reverse of itemKey.
+func parseItemKey(prefix, key string) (uint64, error) {
+	return strconv.ParseUint(strings.Trim(strings.TrimPrefix(key, prefix), "{}"), 10, 64)
+}
+
+// The connections to go through for scanning the whole keyspace: the masters with RedisCluster, or the shards.
+// The caller closes them.
+func (idx *Index) keyspaceConns() []redis.Conn {
+	if idx.cluster() {
+		return idx.masterConns()
+	}
+	conns := make([]redis.Conn, idx.shardCount())
+	for i := range conns {
+		conns[i] = idx.primaryConn(i)
+	}
+	return conns
+}
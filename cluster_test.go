@@ -0,0 +1,29 @@
+package tagstack
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashTag(t *testing.T) {
+	index := &Index{What: "blog.", RedisCluster: true}
+
+	n := newIndexNode(index, []string{"B", "A"}, 1.0)
+	must(n.idstr(const_key_idx_base_set) == "blog.tbin.{A|B}", "node key:", n.idstr(const_key_idx_base_set))
+	must(index.itemCombinationKey(42) == "blog.tics.{42}", "item combination key:", index.itemCombinationKey(42))
+	id, err := parseItemKey(const_key_item_tag_hash, index.itemKey(const_key_item_tag_hash, 42))
+	must(err == nil && id == 42, "item key:", id, err)
+	must(index.tagDictKey(const_key_tag_dict_count) == "blog.tdct.{blog.tdlx.}", "dict key:", index.tagDictKey(const_key_tag_dict_count))
+
+	// the braces in a tag don't cut the hash tag short: the keys of a node are in one slot.
+	n = newIndexNode(index, []string{"}a", "{b"}, 1.0)
+	for _, key := range n.rankKeys() {
+		s := key.(string)
+		begin := strings.IndexByte(s, '{')
+		end := begin + 1 + strings.IndexByte(s[begin+1:], '}')
+		must(end > begin+1 && s[begin+1:end] == n.node && end == len(s)-1, "hash tag:", s)
+	}
+
+	// another index in the same process is not on the cluster.
+	must(newIndexNode(&Index{What: "news."}, []string{"A"}, 1.0).idstr(const_key_idx_base_set) == "news.tbin.A", "plain key")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/semicircle/tagstack"
+	"os"
+)
+
+var explainCommand = &command{
+	name:  "explain",
+	usage: "-rules <file or dir> [-json] tags... : show how the rule transforms the tags",
+	run:   runExplain,
+}
+
+func runExplain(args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	rules := fs.String("rules", "", "rule file or directory")
+	asJson := fs.Bool("json", false, "print the explanation as json")
+	fs.Parse(args)
+
+	if *rules == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	r, err := loadRule(*rules)
+	if err != nil {
+		return err
+	}
+	if diags := r.Validate(); len(diags) != 0 {
+		for _, d := range diags {
+			fmt.Fprintln(os.Stderr, "warning:", d)
+		}
+	}
+
+	e := r.Explain(fs.Args())
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(e)
+	}
+	fmt.Println(e)
+	return nil
+}
+
+func loadRule(path string) (*tagstack.Rule, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return tagstack.LoadRuleDir(path)
+	}
+	return tagstack.LoadRuleFile(path)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"github.com/garyburd/redigo/redis"
+	"github.com/semicircle/tagstack"
+	"os"
+)
+
+var suggestCommand = &command{
+	name:  "suggest",
+	usage: "-redis <addr> -what <index> [-rules <file or dir>] : mine rule suggestions from an index, as rule json",
+	run:   runSuggest,
+}
+
+func runSuggest(args []string) error {
+	fs := flag.NewFlagSet("suggest", flag.ExitOnError)
+	addr := fs.String("redis", "127.0.0.1:6379", "redis address")
+	what := fs.String("what", "", "the index's What")
+	boundary := fs.Int("boundary", 100, "the index's HighNodeBoundary")
+	rules := fs.String("rules", "", "the running rule file or directory, its relations are not suggested again")
+	options := &tagstack.RuleSuggestOptions{}
+	fs.IntVar(&options.MaxTags, "max-tags", 0, "analyze the most popular tags only")
+	fs.IntVar(&options.MinCount, "min-count", 0, "ignore the tags with fewer items")
+	fs.Float64Var(&options.EntanglementRatio, "entanglement", 0, "min |A∩B| / |A∪B| for entanglement")
+	fs.Float64Var(&options.ContainingRatio, "containing", 0, "min |A∩B| / |A| for containing")
+	fs.Parse(args)
+
+	if *what == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	index := &tagstack.Index{
+		What:             *what,
+		HighNodeBoundary: *boundary,
+		ItemLoadFunc:     func(id uint64) tagstack.Item { return nil },
+	}
+	if *rules != "" {
+		r, err := loadRule(*rules)
+		if err != nil {
+			return err
+		}
+		index.Rule = r
+	}
+	if err := useRedis(*addr); err != nil {
+		return err
+	}
+	index.Init()
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(index.SuggestRules(options))
+}
+
+// point tagstack to a single redis.
+func useRedis(addr string) error {
+	c, err := redis.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	c.Close()
+
+	dial := func(shard int) redis.Conn {
+		c, err := redis.Dial("tcp", addr)
+		if err != nil {
+			tagstack.Logger.Panicln("redis:", err)
+		}
+		return c
+	}
+	tagstack.GetReadConn, tagstack.GetWriteConn = dial, dial
+	tagstack.RedisShardMax = 1
+	return nil
+}
@@ -0,0 +1,120 @@
+package tagstack
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// How often the combination caps were hit since Init, see MaxCombinationDepth, MaxCombinationNodes & CombinationTimeBudget.
+type CombinationStats struct {
+	// updates expanding combination nodes.
+	Updates uint64
+	// updates capped by each limit.
+	DepthCapped uint64
+	NodeCapped  uint64
+	TimeCapped  uint64
+	// combination nodes written.
+	Nodes uint64
+}
+
+// The counters of the combination caps since Init.
+func (index *Index) CombinationStats() CombinationStats {
+	s := &index.combinationStats
+	return CombinationStats{
+		Updates:     atomic.LoadUint64(&s.Updates),
+		DepthCapped: atomic.LoadUint64(&s.DepthCapped),
+		NodeCapped:  atomic.LoadUint64(&s.NodeCapped),
+		TimeCapped:  atomic.LoadUint64(&s.TimeCapped),
+		Nodes:       atomic.LoadUint64(&s.Nodes),
+	}
+}
+
+// the limits of one item's combination expansion.
+type combinationBudget struct {
+	idx      *Index
+	nodes    int
+	deadline time.Time
+
+	depthCapped bool
+	nodeCapped  bool
+	timeCapped  bool
+}
+
+func (idx *Index) newCombinationBudget() *combinationBudget {
+	b := &combinationBudget{idx: idx}
+	if idx.CombinationTimeBudget > 0 {
+		b.deadline = time.Now().Add(idx.CombinationTimeBudget)
+	}
+	return b
+}
+
+// can a combination node of depth tags be written ?
+func (b *combinationBudget) allow(depth int) bool {
+	if b.exhausted() {
+		return false
+	}
+	if depth < 2 {
+		// the basic nodes, attached already.
+		return true
+	}
+	if b.idx.MaxCombinationDepth > 0 && depth > b.idx.MaxCombinationDepth {
+		b.depthCapped = true
+		return false
+	}
+	b.nodes++
+	return true
+}
+
+// no more combination nodes can be written for this item.
+func (b *combinationBudget) exhausted() bool {
+	if b.nodeCapped || b.timeCapped {
+		return true
+	}
+	if b.idx.MaxCombinationNodes > 0 && b.nodes >= b.idx.MaxCombinationNodes {
+		b.nodeCapped = true
+		return true
+	}
+	if !b.deadline.IsZero() && time.Now().After(b.deadline) {
+		b.timeCapped = true
+		return true
+	}
+	return false
+}
+
+func (b *combinationBudget) report(item Item) {
+	s := &b.idx.combinationStats
+	atomic.AddUint64(&s.Updates, 1)
+	atomic.AddUint64(&s.Nodes, uint64(b.nodes))
+	if b.depthCapped {
+		atomic.AddUint64(&s.DepthCapped, 1)
+	}
+	if b.nodeCapped {
+		atomic.AddUint64(&s.NodeCapped, 1)
+	}
+	if b.timeCapped {
+		atomic.AddUint64(&s.TimeCapped, 1)
+	}
+	if b.nodeCapped || b.timeCapped {
+		b.idx.logger().Println("Combinations capped:", b.idx.What, "id:", item.Id(), "nodes:", b.nodes)
+	}
+}
+
+// the indexes of scores, the highest first. ties keep their order.
+func scoreOrder(scores []float64) []int {
+	s := &scoreOrderSorter{order: make([]int, len(scores)), scores: scores}
+	for i := range s.order {
+		s.order[i] = i
+	}
+	sort.Stable(s)
+	return s.order
+}
+
+type scoreOrderSorter struct {
+	order  []int
+	scores []float64
+}
+
+func (s *scoreOrderSorter) Len() int           { return len(s.order) }
+func (s *scoreOrderSorter) Swap(i, j int)      { s.order[i], s.order[j] = s.order[j], s.order[i] }
+func (s *scoreOrderSorter) Less(i, j int) bool { return s.scores[s.order[i]] > s.scores[s.order[j]] }
@@ -0,0 +1,19 @@
+package tagstack
+
+import (
+	"testing"
+)
+
+func TestScoreOrder(t *testing.T) {
+	order := scoreOrder([]float64{0.5, 1.0, 0.5, 0.8})
+	must(len(order) == 4 && order[0] == 1 && order[1] == 3 && order[2] == 0 && order[3] == 2, "scoreOrder:", order)
+}
+
+func TestCombinationBudget(t *testing.T) {
+	b := (&Index{MaxCombinationDepth: 2, MaxCombinationNodes: 2}).newCombinationBudget()
+	must(b.allow(1), "basic nodes are always allowed")
+	must(!b.allow(3) && b.depthCapped, "depth cap")
+	must(b.allow(2) && b.allow(2), "node cap")
+	must(!b.allow(2) && b.nodeCapped && b.exhausted(), "node cap")
+	must(b.nodes == 2, "nodes:", b.nodes)
+}
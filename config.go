@@ -0,0 +1,81 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"log"
+)
+
+// The settings of an index fall back to the package-level globals of the same names when they're zero,
+// so two indexes in one process can use different Redis, loggers or notifiers, and the old setups still work.
+
+func (idx *Index) primaryConn(shard int) redis.Conn {
+	if idx.GetReadConn != nil {
+		return idx.GetReadConn(shard)
+	}
+	return GetReadConn(shard)
+}
+
+func (idx *Index) writeConn(shard int) redis.Conn {
+	if idx.GetWriteConn != nil {
+		return idx.GetWriteConn(shard)
+	}
+	return GetWriteConn(shard)
+}
+
+func (idx *Index) masterConns() []redis.Conn {
+	if idx.GetMasterConns != nil {
+		return idx.GetMasterConns()
+	}
+	if GetMasterConns == nil {
+		idx.logger().Panicln("GetMasterConns is nil.")
+	}
+	return GetMasterConns()
+}
+
+func (idx *Index) shardMax() int {
+	if idx.RedisShardMax > 0 {
+		return idx.RedisShardMax
+	}
+	return RedisShardMax
+}
+
+func (idx *Index) router() *ShardRouter {
+	if idx.Router != nil {
+		return idx.Router
+	}
+	return Router
+}
+
+func (idx *Index) cluster() bool {
+	return idx.RedisCluster || RedisCluster
+}
+
+func (idx *Index) logger() *log.Logger {
+	if idx.Logger != nil {
+		return idx.Logger
+	}
+	return Logger
+}
+
+func (idx *Index) debugLogger() *log.Logger {
+	if idx.DebugLogger != nil {
+		return idx.DebugLogger
+	}
+	return DebugLogger
+}
+
+func (idx *Index) notifyHigh(tags []string) {
+	if idx.HighTagNotifyFunc != nil {
+		idx.HighTagNotifyFunc(tags)
+	} else if HighTagNofityFunc != nil {
+		HighTagNofityFunc(tags)
+	}
+}
+
+func (idx *Index) notifyLow(tags []string) {
+	if idx.LowTagNotifyFunc != nil {
+		idx.LowTagNotifyFunc(tags)
+	} else if LowTagNotifyFunc != nil {
+		LowTagNotifyFunc(tags)
+	}
+}
@@ -0,0 +1,102 @@
+package tagstack
+
+// the keys of a node.
+var const_node_keys = []string{
+	const_key_idx_base_set,
+	const_key_idx_score_rank,
+	const_key_idx_date_rank,
+	const_key_idx_overall_rank,
+	const_key_idx_relative_rank,
+	const_key_idx_rand_sug_set,
+}
+
+// the reverse of updatingBombTest: demote a high node having too few items.
+func (idx *Index) demotionTest(n *index_node) bool {
+	if n.isHigh() && n.itemCount() < idx.lowBoundary(n) {
+		idx.demote(n)
+		return true
+	}
+	return false
+}
+
+// a demoted node keeps its items, but the deeper nodes are dropped, with the relative tags they made.
+func (idx *Index) demote(n *index_node) {
+	c := idx.writeConn(idx.highTagsShard(n.shard))
+	idx.ast2(c.Do("SREM", const_key_high_tags_set+n.idx.What, n.node))
+	c.Close()
+
+	c = idx.writeConn(n.shard)
+	c.Send("DEL", n.idstr(const_key_idx_relative_rank))
+	c.Send("DEL", n.idstr(const_key_idx_rand_sug_set))
+	c.Flush()
+	idx.ast2(c.Receive())
+	idx.ast2(c.Receive())
+	c.Close()
+
+	dropped := 0
+	for _, combination := range idx.combinationsOfTag(n.tags[0]) {
+		tags := splitTags(combination)
+		if len(tags) > len(n.tags) && containsTags(tags, n.tags) {
+			idx.dropNode(tags)
+			dropped++
+		}
+	}
+
+	idx.logger().Println("A high tag demoted:", idx.What, n.tags)
+	idx.logger().Println("Dropped deeper nodes:", idx.What, dropped)
+	go idx.notifyLow(n.tags)
+}
+
+// delete a combination node completely, with what it made in the other nodes.
+func (idx *Index) dropNode(tags []string) {
+	n := newIndexNode(idx, tags, 1.0)
+	c := idx.writeConn(n.shard)
+	for _, key := range const_node_keys {
+		c.Send("DEL", n.idstr(key))
+	}
+	c.Flush()
+	for range const_node_keys {
+		idx.ast2(c.Receive())
+	}
+	c.Close()
+
+	c = idx.writeConn(idx.highTagsShard(n.shard))
+	idx.ast2(c.Do("SREM", const_key_high_tags_set+idx.What, n.node))
+	c.Close()
+
+	n.unregisterCombination()
+
+	// the relative tags & the random suggestions the node made in the one tag shorter nodes.
+	for i, tag := range tags {
+		shorter := make([]string, 0, len(tags)-1)
+		shorter = append(append(shorter, tags[:i]...), tags[i+1:]...)
+		ns := newIndexNode(idx, shorter, 1.0)
+		c := idx.writeConn(ns.shard)
+		c.Send("ZREM", ns.idstr(const_key_idx_relative_rank), tag)
+		c.Send("SREM", ns.idstr(const_key_idx_rand_sug_set), tag)
+		c.Flush()
+		idx.ast2(c.Receive())
+		idx.ast2(c.Receive())
+		c.Close()
+	}
+}
+
+// Demote all the high nodes below their low boundaries, eg: after a lot of items are removed,
+// or after HighNodeLowBoundary is raised. Returns how many nodes are demoted.
+func (index *Index) CollectGarbage() (demoted int) {
+	for i := 0; i < index.shardCount(); i++ {
+		c := index.primaryConn(i)
+		members := make([]string, 0)
+		scanKeys(c, "SSCAN", const_key_high_tags_set+index.What, "*", func(member string) {
+			members = append(members, member)
+		})
+		c.Close()
+
+		for _, member := range members {
+			if index.demotionTest(newIndexNode(index, splitTags(member), 1.0)) {
+				demoted++
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,197 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"sort"
+	"strings"
+)
+
+// The tag dictionary: every indexed tag & alias of an index, for prefix completion.
+// Three sorted sets are kept side by side:
+// 1. the lex set, all members with score 0, to be ranged by ZRANGEBYLEX.
+// 2. the count set, member's score is the item count of the tag's basic node.
+// 3. the pinyin set, like the lex set, but members are "romanized\x00tag", for both full pinyin & initials.
+// 4. the popular sets, one per first rune of the tags & of their romanized forms, scored like the count set,
+// so the short prefixes matching too many tags to read are still ranked by count.
+const (
+	const_key_tag_dict_lex     = "tdlx."
+	const_key_tag_dict_count   = "tdct."
+	const_key_tag_dict_pinyin  = "tdpy."
+	const_key_tag_dict_popular = "tdpp."
+
+	// separates the romanized form and the tag in the pinyin set.
+	const_pinyin_separator = "\x00"
+
+	// how many candidates at most are read from each of the lex, pinyin & popular sets for one completion.
+	const_autocomplete_scan = 200
+)
+
+// Complete a prefix to the most popular tags starting with it.
+// The prefix goes through the same conversions as a query tag does, and the returned tags are the canonical forms,
+// sorted by item count descending.
+// A latin prefix also matches Chinese tags by full pinyin or initials, eg: "gly" or "gulang" for 鼓浪屿.
+func (index *Index) Autocomplete(prefix string, n int) (tags []string) {
+	if n <= 0 {
+		return nil
+	}
+	prefix = index.normalizeTag(prefix)
+	prefix = index.currentRule().normalize(prefix)
+	if prefix == "" {
+		return nil
+	}
+
+	c := index.primaryConn(index.tagDictShard())
+	defer c.Close()
+
+	// the most popular tags of the first rune, then the first matches in lex order.
+	romanized, by_pinyin := pinyinQuery(prefix)
+	candidates := make([]string, 0)
+	for _, key := range uniqueStrings([]string{index.popularKey(prefix), index.popularKey(romanized)}) {
+		if key == "" {
+			continue
+		}
+		popular, _ := redis.Strings(index.ast2(c.Do("ZREVRANGE", key, 0, const_autocomplete_scan-1)))
+		for _, tag := range popular {
+			if strings.HasPrefix(tag, prefix) || by_pinyin && romanizedHasPrefix(tag, romanized) {
+				candidates = append(candidates, tag)
+			}
+		}
+	}
+	candidates = append(candidates, rangeByPrefix(c, index.tagDictKey(const_key_tag_dict_lex), prefix)...)
+	if by_pinyin {
+		for _, member := range rangeByPrefix(c, index.tagDictKey(const_key_tag_dict_pinyin), romanized) {
+			if i := strings.Index(member, const_pinyin_separator); i >= 0 {
+				candidates = append(candidates, member[i+len(const_pinyin_separator):])
+			}
+		}
+	}
+	candidates = uniqueStrings(candidates)
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// the counts in one command.
+	args := []interface{}{index.tagDictKey(const_key_tag_dict_count)}
+	for _, tag := range candidates {
+		args = append(args, tag)
+	}
+	scores, _ := redis.Values(index.ast2(c.Do("ZMSCORE", args...)))
+
+	// fold the candidates into their canonical forms.
+	counts := make(map[string]int)
+	for i, tag := range candidates {
+		var count int
+		if i < len(scores) {
+			count, _ = redis.Int(scores[i], nil)
+		}
+		canonical := index.currentRule().normalize(tag)
+		if count > counts[canonical] {
+			counts[canonical] = count
+		}
+	}
+
+	s := &tagCountSorter{tags: make([]string, 0, len(counts)), counts: make([]int, 0, len(counts))}
+	for tag, count := range counts {
+		s.tags = append(s.tags, tag)
+		s.counts = append(s.counts, count)
+	}
+	sort.Sort(s)
+
+	if len(s.tags) > n {
+		return s.tags[:n]
+	}
+	return s.tags
+}
+
+// the first members of the lex set starting with prefix, const_autocomplete_scan at most.
+func rangeByPrefix(c redis.Conn, key, prefix string) []string {
+	members, _ := redis.Strings(ast2(c.Do("ZRANGEBYLEX", key, "["+prefix, "["+prefix+"\xff", "LIMIT", 0, const_autocomplete_scan)))
+	return members
+}
+
+// does the full pinyin or the initials of the tag start with the romanized prefix ?
+func romanizedHasPrefix(tag, romanized string) bool {
+	for _, r := range romanize(tag) {
+		if strings.HasPrefix(r, romanized) {
+			return true
+		}
+	}
+	return false
+}
+
+// the popular set of the first rune of s, "" if s is empty.
+func (idx *Index) popularKey(s string) string {
+	for _, r := range s {
+		return idx.tagDictKey(const_key_tag_dict_popular + escapeTag(string(r)))
+	}
+	return ""
+}
+
+func (idx *Index) tagDictKey(key string) string {
+	return idx.What + key + idx.clusterTag(idx.What+const_key_tag_dict_lex)
+}
+
+func (idx *Index) tagDictShard() int {
+	return idx.str2shard(idx.What + const_key_tag_dict_lex)
+}
+
+// sync the dictionary entry of a basic (single tag) node with its item count.
+func (idx *Index) refreshTagDict(n *index_node) {
+	if len(n.tags) != 1 || n.tags[0] == "" || strings.HasPrefix(n.tags[0], "belongs_to") {
+		return
+	}
+	tag := n.tags[0]
+	count := n.itemCount()
+
+	romanized := romanize(tag)
+
+	popular := make([]string, 0, 1+len(romanized))
+	for _, s := range append([]string{tag}, romanized...) {
+		popular = append(popular, idx.popularKey(s))
+	}
+	popular = uniqueStrings(popular)
+
+	c := idx.writeConn(idx.tagDictShard())
+	defer c.Close()
+	if count > 0 {
+		c.Send("ZADD", idx.tagDictKey(const_key_tag_dict_lex), 0, tag)
+		c.Send("ZADD", idx.tagDictKey(const_key_tag_dict_count), count, tag)
+		for _, r := range romanized {
+			c.Send("ZADD", idx.tagDictKey(const_key_tag_dict_pinyin), 0, r+const_pinyin_separator+tag)
+		}
+		for _, key := range popular {
+			c.Send("ZADD", key, count, tag)
+		}
+	} else {
+		c.Send("ZREM", idx.tagDictKey(const_key_tag_dict_lex), tag)
+		c.Send("ZREM", idx.tagDictKey(const_key_tag_dict_count), tag)
+		for _, r := range romanized {
+			c.Send("ZREM", idx.tagDictKey(const_key_tag_dict_pinyin), r+const_pinyin_separator+tag)
+		}
+		for _, key := range popular {
+			c.Send("ZREM", key, tag)
+		}
+	}
+	c.Flush()
+	for i := 0; i < 2+len(romanized)+len(popular); i++ {
+		idx.ast2(c.Receive())
+	}
+}
+
+// sort tags by count descending, then by tag.
+type tagCountSorter struct {
+	tags   []string
+	counts []int
+}
+
+func (s *tagCountSorter) Len() int { return len(s.tags) }
+func (s *tagCountSorter) Swap(i, j int) {
+	s.tags[i], s.tags[j] = s.tags[j], s.tags[i]
+	s.counts[i], s.counts[j] = s.counts[j], s.counts[i]
+}
+func (s *tagCountSorter) Less(i, j int) bool {
+	if s.counts[i] != s.counts[j] {
+		return s.counts[i] > s.counts[j]
+	}
+	return s.tags[i] < s.tags[j]
+}
@@ -0,0 +1,133 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+)
+
+// Display forms: the index only knows the normalized tags, so the original forms are counted per tag,
+// the most common one is what the users should see.
+const (
+	// item display records: normalized tag -> original form.
+	const_key_item_display_hash = "tidf."
+
+	// per basic node: original forms ranked by how many items use them.
+	const_key_tag_display_rank = "tdsr."
+)
+
+// A tag as the index knows it, and as the users should see it.
+type TagDisplay struct {
+	Key     string
+	Display string
+}
+
+// The display forms of the tags, a tag without any record is displayed as it is.
+// The lookups are pipelined per shard.
+func (index *Index) DisplayForms(keys []string) []string {
+	ret := make([]string, len(keys))
+	nodes := make([]*index_node, len(keys))
+	groups := make(map[int][]int)
+	for i, key := range keys {
+		ret[i] = key
+		nodes[i] = newIndexNode(index, []string{key}, 1.0)
+		group := nodes[i].shard
+		if index.cluster() {
+			// the keys are in different slots, no pipelining across them.
+			group = i
+		}
+		groups[group] = append(groups[group], i)
+	}
+
+	for _, group := range groups {
+		c := index.primaryConn(nodes[group[0]].shard)
+		for _, i := range group {
+			c.Send("ZREVRANGE", nodes[i].idstr(const_key_tag_display_rank), 0, 0)
+		}
+		index.ast(c.Flush())
+		for _, i := range group {
+			forms, _ := redis.Strings(index.ast2(c.Receive()))
+			if len(forms) != 0 {
+				ret[i] = forms[0]
+			}
+		}
+		c.Close()
+	}
+	return ret
+}
+
+// RelativeTags with the display forms.
+func (index *Index) RelativeTagsDisplay(tags []string, count int) []TagDisplay {
+	return index.withDisplayForms(index.RelativeTags(tags, count))
+}
+
+// RandomSuggestTags with the display forms.
+func (index *Index) RandomSuggestTagsDisplay(tags []string, count int) []TagDisplay {
+	return index.withDisplayForms(index.RandomSuggestTags(tags, count))
+}
+
+// Autocomplete with the display forms.
+func (index *Index) AutocompleteDisplay(prefix string, n int) []TagDisplay {
+	return index.withDisplayForms(index.Autocomplete(prefix, n))
+}
+
+func (idx *Index) withDisplayForms(keys []string) []TagDisplay {
+	forms := idx.DisplayForms(keys)
+	ret := make([]TagDisplay, len(keys))
+	for i, key := range keys {
+		ret[i] = TagDisplay{Key: key, Display: forms[i]}
+	}
+	return ret
+}
+
+// the item's display records, per index as the forms are counted per index.
+func (idx *Index) itemDisplayKey(id uint64) string {
+	return idx.What + const_key_item_display_hash + idx.hashTag(strconv.FormatUint(id, 10))
+}
+
+// replace the item's display records, and move the counts from the old forms to the new ones.
+// infos == nil removes the records.
+func (idx *Index) setItemDisplayForms(id uint64, infos []*taginfo) {
+	key := idx.itemDisplayKey(id)
+
+	c := idx.writeConn(idx.id2shard(id))
+	defer c.Close()
+
+	last, _ := redis.StringMap(idx.ast2(c.Do("HGETALL", key)))
+	curr := make(map[string]string, len(infos))
+	for _, info := range infos {
+		if info.display != "" {
+			curr[info.title] = info.display
+		}
+	}
+
+	for title, display := range last {
+		if curr[title] != display {
+			idx.countDisplayForm(title, display, -1)
+		}
+	}
+	for title, display := range curr {
+		if last[title] != display {
+			idx.countDisplayForm(title, display, 1)
+		}
+	}
+
+	c.Send("DEL", key)
+	for title, display := range curr {
+		c.Send("HSET", key, title, display)
+	}
+	idx.ast(c.Flush())
+	for i := 0; i < len(curr)+1; i++ {
+		idx.ast2(c.Receive())
+	}
+}
+
+func (idx *Index) countDisplayForm(title, display string, delta int) {
+	n := newIndexNode(idx, []string{title}, 1.0)
+	c := idx.writeConn(n.shard)
+	defer c.Close()
+	key := n.idstr(const_key_tag_display_rank)
+	idx.ast2(c.Do("ZINCRBY", key, delta, display))
+	if delta < 0 {
+		idx.ast2(c.Do("ZREMRANGEBYSCORE", key, "-inf", 0))
+	}
+}
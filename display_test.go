@@ -0,0 +1,45 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"testing"
+)
+
+// a connection answering every command by reply, pipelined or not.
+type replyConn struct {
+	reply   func(cmd string, args []interface{}) interface{}
+	pending []interface{}
+}
+
+func (c *replyConn) Close() error { return nil }
+func (c *replyConn) Err() error   { return nil }
+func (c *replyConn) Flush() error { return nil }
+func (c *replyConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	return c.reply(cmd, args), nil
+}
+func (c *replyConn) Send(cmd string, args ...interface{}) error {
+	c.pending = append(c.pending, c.reply(cmd, args))
+	return nil
+}
+func (c *replyConn) Receive() (interface{}, error) {
+	reply := c.pending[0]
+	c.pending = c.pending[1:]
+	return reply, nil
+}
+
+func TestRandomSuggestTagsDisplay(t *testing.T) {
+	c := &replyConn{reply: func(cmd string, args []interface{}) interface{} {
+		switch {
+		case cmd == "SRANDMEMBER":
+			return []interface{}{[]byte("go"), []byte("x")}
+		case cmd == "ZREVRANGE" && strings.HasSuffix(args[0].(string), const_key_tag_display_rank+"go"):
+			return []interface{}{[]byte("Go")}
+		}
+		return []interface{}{}
+	}}
+	index := &Index{What: "t.", GetReadConn: func(int) redis.Conn { return c }, rule: (&Rule{}).init()}
+
+	sugs := index.RandomSuggestTagsDisplay([]string{"A"}, 2)
+	must(len(sugs) == 2 && sugs[0] == TagDisplay{Key: "go", Display: "Go"} && sugs[1] == TagDisplay{Key: "x", Display: "x"}, "RandomSuggestTagsDisplay:", sugs)
+}
@@ -0,0 +1,309 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Query time rule expansion, for RULE_EXPANSION_SEARCHING:
+// a query tag is the union of the basic nodes it stands for, and the query is the intersection of the unions.
+
+// expand each tag, expanded is false if no tag stands for more than itself.
+func (idx *Index) expandTags(tags []string) (expansions []map[string]float64, expanded bool) {
+	r := idx.currentRule()
+	expansions = make([]map[string]float64, len(tags))
+	for i, tag := range tags {
+		expansions[i] = r.expandForSearching(tag)
+		if len(expansions[i]) > 1 {
+			expanded = true
+		}
+	}
+	return
+}
+
+func (idx *Index) queryExpanded(expansions []map[string]float64, sorting_key string, start, stop int) (ids []uint64) {
+	if len(expansions) == 0 {
+		return nil
+	}
+	if start < 0 || stop < 0 {
+		// counted from the end, as ZREVRANGE does.
+		start, stop = resolveRange(start, stop, idx.itemCountExpanded(expansions))
+	}
+	if stop < start {
+		return nil
+	}
+
+	// drive by the smallest union, filter by the others.
+	driving := 0
+	min_count := -1
+	for i, expansion := range expansions {
+		count := 0
+		for tag := range expansion {
+			count += idx.readNode([]string{tag}).itemCount()
+		}
+		if min_count == -1 || count < min_count {
+			min_count = count
+			driving = i
+		}
+	}
+
+	window := stop + 1
+	for {
+		scores := make(map[uint64]float64)
+		// the items not fetched yet are all below this.
+		threshold := math.Inf(-1)
+		for tag, weight := range expansions[driving] {
+			n := idx.readNode([]string{tag})
+			fetched_ids, fetched_scores := n.itemsRevrangeWithScores(sorting_key, 0, window-1)
+			for i, id := range fetched_ids {
+				score := weightedScore(sorting_key, fetched_scores[i], weight)
+				if last, ok := scores[id]; !ok || score > last {
+					scores[id] = score
+				}
+			}
+			if len(fetched_ids) == window {
+				if last := weightedScore(sorting_key, fetched_scores[window-1], weight); last > threshold {
+					threshold = last
+				}
+			}
+		}
+
+		s := &idScoreSorter{ids: make([]uint64, 0, len(scores)), scores: make([]float64, 0, len(scores))}
+		for id, score := range scores {
+			s.ids = append(s.ids, id)
+			s.scores = append(s.scores, score)
+		}
+		sort.Sort(s)
+
+		confirmed := s.ids
+		for i, expansion := range expansions {
+			if i != driving {
+				confirmed = idx.expandedItemFilter(expansion, confirmed)
+			}
+		}
+
+		// only the ones above the threshold are surely in order.
+		certain := confirmed
+		for i, id := range confirmed {
+			if scores[id] < threshold {
+				certain = confirmed[:i]
+				break
+			}
+		}
+
+		if len(certain) > stop || math.IsInf(threshold, -1) {
+			if start >= len(certain) {
+				return nil
+			}
+			if stop >= len(certain) {
+				stop = len(certain) - 1
+			}
+			return certain[start : stop+1]
+		}
+		window *= 2
+	}
+}
+
+// the subjects in any of the expansion's nodes.
+func (idx *Index) expandedItemFilter(expansion map[string]float64, subjects []uint64) []uint64 {
+	in := make(map[uint64]bool, len(subjects))
+	for tag := range expansion {
+		n := idx.readNode([]string{tag})
+		for _, id := range n.itemFilter(subjects) {
+			in[id] = true
+		}
+	}
+	ret := make([]uint64, 0, len(in))
+	for _, id := range subjects {
+		if in[id] {
+			ret = append(ret, id)
+		}
+	}
+	return ret
+}
+
+// resolve the negative indexes of a range against the length, like ZREVRANGE: stop < start if it's empty.
+func resolveRange(start, stop, length int) (int, int) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	return start, stop
+}
+
+func (idx *Index) itemCountExpanded(expansions []map[string]float64) int {
+	var items map[uint64]bool
+	for _, expansion := range expansions {
+		union := make(map[uint64]bool)
+		for tag := range expansion {
+			for _, id := range idx.readNode([]string{tag}).items() {
+				if items == nil || items[id] {
+					union[id] = true
+				}
+			}
+		}
+		items = union
+	}
+	return len(items)
+}
+
+// the nodes standing for the expanded tags: one per combination of the expansions' tags, with the combined weight.
+// At most const_expansion_max_nodes are kept, the heaviest first.
+const const_expansion_max_nodes = 64
+
+func expansionNodes(expansions []map[string]float64) (nodes [][]string, weights []float64) {
+	nodes, weights = [][]string{{}}, []float64{1.0}
+	for _, expansion := range expansions {
+		next_nodes := make([][]string, 0, len(nodes)*len(expansion))
+		next_weights := make([]float64, 0, len(nodes)*len(expansion))
+		for i, node := range nodes {
+			for tag, weight := range expansion {
+				next := append([]string{}, node...)
+				if !containsTags(node, []string{tag}) {
+					next = append(next, tag)
+				}
+				next_nodes = append(next_nodes, next)
+				next_weights = append(next_weights, weights[i]*weight)
+			}
+		}
+		nodes, weights = next_nodes, next_weights
+	}
+
+	s := &tagsScoreSorter{tags: nodes, scores: weights}
+	sort.Sort(s)
+	if len(nodes) > const_expansion_max_nodes {
+		nodes, weights = nodes[:const_expansion_max_nodes], weights[:const_expansion_max_nodes]
+	}
+	return
+}
+
+// RelativeTags over the expanded nodes: the relative ranks are summed up by weight, the query's own tags left out.
+func (idx *Index) relativeTagsExpanded(expansions []map[string]float64, count int) []string {
+	own := make(map[string]bool)
+	for _, expansion := range expansions {
+		for tag := range expansion {
+			own[tag] = true
+		}
+	}
+
+	scores := make(map[string]float64)
+	nodes, weights := expansionNodes(expansions)
+	for i, tags := range nodes {
+		n := idx.readNode(tags)
+		c := n.readConn()
+		vals, _ := redis.Values(idx.ast2(c.Do("ZREVRANGE", n.idstr(const_key_idx_relative_rank), 0, count-1+len(own), "WITHSCORES")))
+		c.Close()
+		for j := 0; j < len(vals); j += 2 {
+			tag, _ := redis.String(vals[j], nil)
+			score, _ := redis.Float64(vals[j+1], nil)
+			if !own[tag] {
+				scores[tag] += score * weights[i]
+			}
+		}
+	}
+
+	s := &tagsScoreSorter{tags: make([][]string, 0, len(scores)), scores: make([]float64, 0, len(scores))}
+	for tag, score := range scores {
+		s.tags = append(s.tags, []string{tag})
+		s.scores = append(s.scores, score)
+	}
+	sort.Sort(s)
+	ret := make([]string, 0, count)
+	for i := 0; i < len(s.tags) && i < count; i++ {
+		ret = append(ret, s.tags[i][0])
+	}
+	return ret
+}
+
+// RandomSuggestTags over the expanded nodes.
+func (idx *Index) randomSuggestTagsExpanded(expansions []map[string]float64, count int) []string {
+	seen := make(map[string]bool)
+	ret := make([]string, 0, count)
+	nodes, _ := expansionNodes(expansions)
+	for _, tags := range nodes {
+		for _, tag := range idx.readNode(tags).randomSuggestTags(count) {
+			if !seen[tag] {
+				seen[tag] = true
+				ret = append(ret, tag)
+			}
+		}
+	}
+	// mix the nodes' suggestions up before cutting.
+	for i := len(ret) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		ret[i], ret[j] = ret[j], ret[i]
+	}
+	if len(ret) > count {
+		ret = ret[:count]
+	}
+	return ret
+}
+
+// weight a score the way the alias node would have when indexing.
+func weightedScore(sorting_key string, score, weight float64) float64 {
+	switch sorting_key {
+	case const_key_idx_score_rank:
+		return score * weight
+	case const_key_idx_overall_rank:
+		// the overall score is logarithmic, see fade_score.
+		return score + math.Log10(weight)
+	}
+	return score
+}
+
+func (node *index_node) itemsRevrangeWithScores(sorting_key string, start, stop int) (ids []uint64, scores []float64) {
+	c := node.readConn()
+	defer c.Close()
+	vals, _ := redis.Values(node.idx.ast2(c.Do("ZREVRANGE", node.idstr(sorting_key), start, stop, "WITHSCORES")))
+	ids = make([]uint64, len(vals)/2)
+	scores = make([]float64, len(vals)/2)
+	for i := 0; i < len(vals); i += 2 {
+		ids[i/2], _ = redis.Uint64(vals[i], nil)
+		scores[i/2], _ = redis.Float64(vals[i+1], nil)
+	}
+	return
+}
+
+// sort ids by score descending, then by id descending as ZREVRANGE does.
+type idScoreSorter struct {
+	ids    []uint64
+	scores []float64
+}
+
+func (s *idScoreSorter) Len() int { return len(s.ids) }
+func (s *idScoreSorter) Swap(i, j int) {
+	s.ids[i], s.ids[j] = s.ids[j], s.ids[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
+func (s *idScoreSorter) Less(i, j int) bool {
+	if s.scores[i] != s.scores[j] {
+		return s.scores[i] > s.scores[j]
+	}
+	return s.ids[i] > s.ids[j]
+}
+
+// sort tags by score descending, then by the tags.
+type tagsScoreSorter struct {
+	tags   [][]string
+	scores []float64
+}
+
+func (s *tagsScoreSorter) Len() int { return len(s.tags) }
+func (s *tagsScoreSorter) Swap(i, j int) {
+	s.tags[i], s.tags[j] = s.tags[j], s.tags[i]
+	s.scores[i], s.scores[j] = s.scores[j], s.scores[i]
+}
+func (s *tagsScoreSorter) Less(i, j int) bool {
+	if s.scores[i] != s.scores[j] {
+		return s.scores[i] > s.scores[j]
+	}
+	return strings.Join(s.tags[i], const_tags_separator) < strings.Join(s.tags[j], const_tags_separator)
+}
@@ -0,0 +1,37 @@
+package tagstack
+
+import (
+	"testing"
+)
+
+func TestExpansionNodes(t *testing.T) {
+	nodes, weights := expansionNodes([]map[string]float64{
+		{"A": 1.0, "A2": 0.5},
+		{"B": 1.0, "A": 0.8},
+	})
+	must(len(nodes) == 4 && len(weights) == 4, "expansionNodes:", nodes)
+	must(len(nodes[0]) == 2 && nodes[0][0] == "A" && nodes[0][1] == "B" && weights[0] == 1.0, "the heaviest first:", nodes[0], weights[0])
+	must(len(nodes[1]) == 1 && nodes[1][0] == "A" && weights[1] == 0.8, "a tag is only once in a node:", nodes[1], weights[1])
+	must(weights[3] == 0.4, "the combined weight:", weights)
+
+	expansions := make([]map[string]float64, 3)
+	for i := range expansions {
+		expansions[i] = map[string]float64{}
+		for j := 0; j < 5; j++ {
+			expansions[i][string(rune('a'+i*5+j))] = 1.0
+		}
+	}
+	nodes, _ = expansionNodes(expansions)
+	must(len(nodes) == const_expansion_max_nodes, "expansionNodes capped:", len(nodes))
+}
+
+func TestResolveRange(t *testing.T) {
+	start, stop := resolveRange(0, -1, 5)
+	must(start == 0 && stop == 4, "(0, -1):", start, stop)
+	start, stop = resolveRange(-2, -1, 5)
+	must(start == 3 && stop == 4, "(-2, -1):", start, stop)
+	start, stop = resolveRange(-10, 1, 5)
+	must(start == 0 && stop == 1, "(-10, 1):", start, stop)
+	start, stop = resolveRange(0, -1, 0)
+	must(stop < start, "empty:", start, stop)
+}
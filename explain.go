@@ -0,0 +1,105 @@
+package tagstack
+
+import (
+	"fmt"
+	"strings"
+)
+
+// How the rules transform a group of tags, see Rule.Explain.
+type RuleExplanation struct {
+	Input []string
+
+	// every decision, in the order the rules are applied.
+	Steps []ExplainStep
+
+	// the taginfos left for indexing.
+	Indexed []ExplainedTag
+
+	// the tags a query of the input would search.
+	Searched []string
+}
+
+type ExplainStep struct {
+	Stage  string // normalizer / normalization / containing / entanglement
+	Tag    string
+	Detail string
+}
+
+type ExplainedTag struct {
+	Title       string
+	Aliases     []string
+	AliasScores []float64
+}
+
+// Explain what applying the rule does to the tags, both for indexing & searching.
+func (r *Rule) Explain(tags []string) *RuleExplanation {
+	return explainRule(r.init(), tags)
+}
+
+// Like Rule.Explain, with the index's normalizers, its running rule & its RuleExpansion.
+func (index *Index) Explain(tags []string) *RuleExplanation {
+	normalized := make([]string, 0, len(tags))
+	steps := make([]ExplainStep, 0, len(tags))
+	for _, tag := range tags {
+		n := index.normalizeTag(tag)
+		switch {
+		case n == "":
+			steps = append(steps, ExplainStep{"normalizer", tag, "dropped"})
+			continue
+		case n != tag:
+			steps = append(steps, ExplainStep{"normalizer", tag, fmt.Sprintf("normalized to %q", n)})
+		}
+		normalized = append(normalized, n)
+	}
+
+	r := *index.currentRule()
+	if index.RuleExpansion == RULE_EXPANSION_SEARCHING {
+		// aliases are left to the query time.
+		r.contain_map = nil
+		r.entg_map = nil
+	}
+	e := explainRule(&r, normalized)
+	e.Input = tags
+	e.Steps = append(steps, e.Steps...)
+	return e
+}
+
+func explainRule(r *rule, tags []string) *RuleExplanation {
+	e := &RuleExplanation{Input: tags}
+
+	traced := *r
+	traced.trace = func(stage, tag, detail string) {
+		e.Steps = append(e.Steps, ExplainStep{stage, tag, detail})
+	}
+
+	infos := make([]*taginfo, len(tags))
+	for i, tag := range tags {
+		infos[i] = &taginfo{title: tag, score: 1.0, enrelative: true}
+	}
+	for _, info := range traced.applyRulesForIndexing(infos) {
+		e.Indexed = append(e.Indexed, ExplainedTag{Title: info.title, Aliases: info.aliases, AliasScores: info.alias_scores})
+	}
+
+	search := make([]string, len(tags))
+	copy(search, tags)
+	e.Searched = r.applyRulesForSearching(search)
+	return e
+}
+
+func (e *RuleExplanation) String() string {
+	lines := make([]string, 0, len(e.Steps)+len(e.Indexed)+4)
+	lines = append(lines, "input: "+strings.Join(e.Input, ", "))
+	for _, step := range e.Steps {
+		lines = append(lines, fmt.Sprintf("  [%s] %s: %s", step.Stage, step.Tag, step.Detail))
+	}
+	lines = append(lines, "indexed:")
+	for _, tag := range e.Indexed {
+		aliases := make([]string, len(tag.Aliases))
+		for i, alias := range tag.Aliases {
+			aliases[i] = fmt.Sprintf("%s(%v)", alias, tag.AliasScores[i])
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s", tag.Title, strings.Join(aliases, ", ")))
+	}
+	lines = append(lines, "searched: "+strings.Join(e.Searched, ", "))
+	return strings.Join(lines, "\n")
+}
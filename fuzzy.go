@@ -0,0 +1,164 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"unicode"
+)
+
+const (
+	// how many candidates at most are read from the lex set for one fuzzy tag.
+	const_fuzzy_scan = 500
+)
+
+// A query tag that was replaced by an indexed tag.
+type TagCorrection struct {
+	From     string // the tag as the caller gave.
+	To       string // the indexed tag it's resolved to.
+	Distance int    // edit distance between the folded forms, 0 if folding alone fixed it.
+}
+
+// Resolve unknown query tags to the closest indexed tags:
+// A tag that's not in the tag dictionary is folded (width, case, spaces) and compared by edit distance against
+// the dictionary, the closest one within FuzzyDistance is taken, the more popular one wins a tie.
+// Tags that can't be resolved are returned as they are.
+// If FuzzyDistance is 0, only folding is applied.
+func (index *Index) CorrectTags(tags []string) (corrected []string, corrections []TagCorrection) {
+	corrected = make([]string, len(tags))
+	for i, tag := range tags {
+		corrected[i] = tag
+		to, distance, ok := index.correctTag(tag)
+		if ok && to != tag {
+			corrected[i] = to
+			corrections = append(corrections, TagCorrection{From: tag, To: to, Distance: distance})
+		}
+	}
+	return
+}
+
+// Query with CorrectTags applied on the tags first, the corrections are reported back.
+func (index *Index) QueryFuzzy(tags []string, start, stop int, options *IndexOptions) (ids []uint64, corrections []TagCorrection) {
+	tags, corrections = index.CorrectTags(tags)
+	ids = index.QueryOptions(tags, start, stop, options)
+	return
+}
+
+func (idx *Index) correctTag(tag string) (to string, distance int, ok bool) {
+	search_form := idx.currentRule().normalize(idx.normalizeTag(tag))
+
+	c := idx.primaryConn(idx.tagDictShard())
+	defer c.Close()
+
+	countKey := idx.tagDictKey(const_key_tag_dict_count)
+	if _, err := redis.Float64(idx.ast2(c.Do("ZSCORE", countKey, search_form))); err != redis.ErrNil {
+		return tag, 0, true
+	}
+
+	folded := foldTag(search_form)
+	if folded == "" {
+		return "", 0, false
+	}
+	folded_runes := []rune(folded)
+
+	// gather the candidates: the whole dictionary if it's small, or else the tags sharing the first character.
+	var candidates []string
+	total, _ := redis.Int(idx.ast2(c.Do("ZCARD", countKey)))
+	if total <= const_fuzzy_scan {
+		candidates, _ = redis.Strings(idx.ast2(c.Do("ZRANGEBYLEX", idx.tagDictKey(const_key_tag_dict_lex), "-", "+")))
+	} else {
+		first := folded_runes[0]
+		prefixes := []string{string(first)}
+		if upper := unicode.ToUpper(first); upper != first {
+			prefixes = append(prefixes, string(upper))
+		}
+		for _, prefix := range prefixes {
+			vals, _ := redis.Strings(idx.ast2(c.Do("ZRANGEBYLEX", idx.tagDictKey(const_key_tag_dict_lex), "["+prefix, "["+prefix+"\xff", "LIMIT", 0, const_fuzzy_scan)))
+			candidates = append(candidates, vals...)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+
+	// a correction shouldn't rewrite the whole tag.
+	max_distance := idx.FuzzyDistance
+	if max_distance >= len(folded_runes) {
+		max_distance = len(folded_runes) - 1
+	}
+
+	best_distance := -1
+	bests := make([]string, 0, 4)
+	for _, candidate := range candidates {
+		d := editDistance(folded_runes, []rune(foldTag(candidate)))
+		if d > max_distance {
+			continue
+		}
+		if best_distance == -1 || d < best_distance {
+			best_distance = d
+			bests = bests[:0]
+		}
+		if d == best_distance {
+			bests = append(bests, candidate)
+		}
+	}
+	if best_distance == -1 {
+		return "", 0, false
+	}
+
+	// tie: the more popular.
+	for _, candidate := range bests {
+		c.Send("ZSCORE", countKey, candidate)
+	}
+	c.Flush()
+	best_count := -1
+	for _, candidate := range bests {
+		count, _ := redis.Int(idx.ast2(c.Receive()))
+		if count > best_count {
+			best_count = count
+			to = candidate
+		}
+	}
+	return to, best_distance, true
+}
+
+// Fold a tag for loose comparing: full width to half width, lower case, and no spaces around or inside.
+func foldTag(tag string) string {
+	return strings.Map(func(r rune) rune {
+		r = foldWidth(r)
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, tag)
+}
+
+// Levenshtein distance.
+func editDistance(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
@@ -0,0 +1,17 @@
+package tagstack
+
+import (
+	"testing"
+)
+
+func TestFoldTag(t *testing.T) {
+	must(foldTag(" Ａｂc　") == "abc", "foldTag:", foldTag(" Ａｂc　"))
+	must(foldTag("鼓 浪屿") == "鼓浪屿", "foldTag:", foldTag("鼓 浪屿"))
+}
+
+func TestEditDistance(t *testing.T) {
+	must(editDistance([]rune("鼓浪屿"), []rune("鼓浪屿")) == 0, "editDistance")
+	must(editDistance([]rune("鼓狼屿"), []rune("鼓浪屿")) == 1, "editDistance")
+	must(editDistance([]rune("kitten"), []rune("sitting")) == 3, "editDistance")
+	must(editDistance([]rune(""), []rune("abc")) == 3, "editDistance")
+}
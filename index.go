@@ -2,8 +2,7 @@ package tagstack
 
 import (
 	"github.com/garyburd/redigo/redis"
-	"github.com/semicircle/gozhszht"
-	"hash/adler32"
+	"log"
 	"runtime/debug"
 	"sort"
 	"strconv"
@@ -24,6 +23,19 @@ type Index struct {
 	// normally a value of 100 is Ok.
 	HighNodeBoundary int
 
+	// Optional: A high node is demoted when its items drop below this, and its deeper nodes are dropped.
+	// It should be lower than HighNodeBoundary to avoid flapping, 0 means HighNodeBoundary / 2.
+	HighNodeLowBoundary int
+
+	// Optional: HighNodeBoundary overridden per tag, keyed by the indexed (normalized) forms.
+	// A hot tag branches early with a lower boundary, a niche tag never needs combinations with a higher one.
+	// A combination node takes the lowest boundary of its tags, and the low boundaries keep the ratio above.
+	TagHighNodeBoundaries map[string]int
+
+	// Optional: Count the queries of each tag, and lower the boundaries of the hot tags accordingly.
+	// Call RebalanceHighNodes periodically to apply the changing boundaries to the existing nodes.
+	AdaptiveHighNodeBoundary bool
+
 	// the rule of this index.
 	// please see type Rule struct for detail.
 	Rule *Rule
@@ -35,6 +47,58 @@ type Index struct {
 	// Note: If the items usually have more than 20 tags, this SHOULD NOT be enabled, because this feature will slow down the indexing progress to a "minutes per update" level.
 	EnableRandomSuggestTags bool
 
+	// Optional: Caps of the combination nodes written for one item, to keep an item with many high tags & aliases
+	// from writing thousands of nodes. 0 means no limit.
+	// The deeper nodes are explored by tag score, so the caps drop the lowest scored combinations first.
+	// A combination deeper than MaxCombinationDepth is never created, the queries fall back to the intersection.
+	// But an item capped by MaxCombinationNodes or CombinationTimeBudget is missing from some existing combinations,
+	// see CombinationStats for how often this happens.
+	MaxCombinationDepth   int
+	MaxCombinationNodes   int
+	CombinationTimeBudget time.Duration
+
+	// Optional: Build no combination nodes when indexing, but materialize the ones queried LazyCombinationQueries times
+	// from the basic nodes, to expire after LazyCombinationTTL (0 means an hour) without queries.
+	// A materialized node is kept up to date by the indexing until it expires.
+	// This trades the latency of the first queries for a smaller index. Note: RelativeTags of the combinations are not built.
+	LazyCombinations       bool
+	LazyCombinationQueries int
+	LazyCombinationTTL     time.Duration
+
+	// Optional: The settings of this index, the package-level globals of the same names are used if these are zero.
+	// Set these to run several indexes in one process with different Redis, loggers or notifiers.
+	GetReadConn, GetWriteConn GetRedisConnFuncType
+	HighTagNotifyFunc         HighTagNotifyFuncType
+	LowTagNotifyFunc          HighTagNotifyFuncType
+	RedisShardMax             int
+	Router                    *ShardRouter
+	RedisCluster              bool
+	GetMasterConns            func() []redis.Conn
+	Logger, DebugLogger       *log.Logger
+
+	// Optional: The connections to the replicas, Query / ItemCount / RelativeTags spread over them,
+	// and fall back to the primary on errors.
+	ReadReplicas []GetRedisConnFuncType
+	// Optional: The replication lag tolerated: for this long after the index writes, the reads go to the primary,
+	// so a caller reading right after Update & WaitAllIndexingDone sees its writes. 0 means the replicas anyway.
+	ReplicaStaleness time.Duration
+
+	// Optional: What tags of the items are worth indexing, see TagPolicy.
+	TagPolicy *TagPolicy
+
+	// Optional: Where Containing & Entanglement of the rule are applied, see RULE_EXPANSION_*.
+	// Changing this on an existing index requires reindexing all the items.
+	RuleExpansion RULE_EXPANSION
+
+	// Optional: The normalizers every tag goes through, in order, both at indexing & searching time.
+	// nil means DefaultNormalizers ({NormalizeSimplified}), a stricter chain eg:
+	// []Normalizer{NormalizeNFKC, NormalizeTrim, NormalizeCase, NormalizeSimplified}
+	Normalizers []Normalizer
+
+	// Optional: The max edit distance for CorrectTags / QueryFuzzy to resolve an unknown query tag to an indexed one.
+	// 0 means only width / case / space folding is tried.
+	FuzzyDistance int
+
 	// private:
 	initOnce    sync.Once
 	initialized bool
@@ -42,8 +106,22 @@ type Index struct {
 	chOp chan *job
 	// wait if everything done.
 	wgDone *sync.WaitGroup
-	// rule
-	rule *rule
+	// the compiled TagPolicy.
+	policy *tagPolicy
+	// the counters of the combination caps.
+	combinationStats CombinationStats
+	// rule, swapped by SetRule.
+	rule     *rule
+	ruleLock sync.RWMutex
+	// the query counts of the tags for AdaptiveHighNodeBoundary, loaded by RebalanceHighNodes.
+	queryCounts     map[string]float64
+	queryCountsLock sync.RWMutex
+	// set once the server turns out to have no scripting.
+	scriptingUnsupported int32
+	// the replica to read next.
+	replicaNext uint32
+	// when the last indexing job is done, in unix nano.
+	lastWrite int64
 }
 
 // options.
@@ -55,6 +133,15 @@ const (
 	SORT_BY_OVERALL
 )
 
+type RULE_EXPANSION int
+
+const (
+	// aliases are written into the index when indexing: fast queries, bigger index.
+	RULE_EXPANSION_INDEXING = iota
+	// only Normalization is applied when indexing, queries are expanded over the basic nodes.
+	RULE_EXPANSION_SEARCHING
+)
+
 type IndexOptions struct {
 	SortBy   SORT_BY
 	Reversal bool   // TODO: feature
@@ -70,18 +157,38 @@ type job struct {
 func (index *Index) Init() {
 	index.initOnce.Do(func() {
 		if index.HighNodeBoundary < 3 {
-			Logger.Panicln("HighNodeBoundary < 3.")
+			index.logger().Panicln("HighNodeBoundary < 3.")
 		}
 
 		if index.ItemLoadFunc == nil {
-			Logger.Panicln("ItemLoadFunc is nil")
+			index.logger().Panicln("ItemLoadFunc is nil")
+		}
+
+		if index.cluster() && strings.ContainsAny(index.What, "{}") {
+			index.logger().Panicln("What with braces breaks the hash tags of Redis Cluster.")
+		}
+
+		if index.HighNodeLowBoundary >= index.HighNodeBoundary {
+			index.logger().Panicln("HighNodeLowBoundary >= HighNodeBoundary.")
+		}
+
+		for tag, boundary := range index.TagHighNodeBoundaries {
+			if boundary < 3 {
+				index.logger().Panicln("TagHighNodeBoundaries < 3:", tag)
+			}
 		}
 
 		index.chOp = make(chan *job, index.HighNodeBoundary*50)
 		index.wgDone = &sync.WaitGroup{}
 		if index.Rule != nil {
-			index.rule = index.Rule.init()
+			if diags := index.Rule.Validate(); len(diags) != 0 {
+				index.logger().Panicln("invalid rule:", diags)
+			}
+			index.rule = index.initRule(index.Rule)
+		} else {
+			index.rule = index.initRule(&Rule{})
 		}
+		index.initTagPolicy()
 
 		go index.workingRountine()
 
@@ -127,12 +234,28 @@ func (index *Index) QueryOptions(tags []string, start, stop int, options *IndexO
 		break
 	}
 
-	tags = convertTags2Simple(tags)
-	tags = index.rule.applyRulesForSearching(tags)
+	tags = index.normalizeTags(tags)
+	tags = index.currentRule().applyRulesForSearching(tags)
+	if len(tags) == 0 {
+		// nothing left to search after normalization.
+		return
+	}
+	index.recordQuery(tags)
+
+	if index.RuleExpansion == RULE_EXPANSION_SEARCHING {
+		if expansions, expanded := index.expandTags(tags); expanded {
+			return index.queryExpanded(expansions, key, start, stop)
+		}
+	}
 
 	/* lucky ? */
-	node := newIndexNode(index.What, tags, 1.0)
+	node := index.readNode(tags)
 	if node.exists() {
+		index.touchLazy(node)
+		ids = node.itemsRevrange(key, start, stop)
+	} else if index.materializeOnQuery(node) {
+		// just written.
+		node.read = nil
 		ids = node.itemsRevrange(key, start, stop)
 	} else {
 		/* not lucky: downgrade */
@@ -142,7 +265,7 @@ func (index *Index) QueryOptions(tags []string, start, stop int, options *IndexO
 		var min_node *index_node
 		min_node_count := 100000
 		for _, tag := range tags {
-			node := newIndexNode(index.What, []string{tag}, 1.0)
+			node := index.readNode([]string{tag})
 			if cnt := node.itemCount(); cnt < min_node_count {
 				min_node_count = cnt
 				min_node = node
@@ -154,7 +277,7 @@ func (index *Index) QueryOptions(tags []string, start, stop int, options *IndexO
 			if tag == min_node.tags[0] {
 				continue
 			}
-			node := newIndexNode(index.What, []string{tag}, 1.0)
+			node := index.readNode([]string{tag})
 			ids = node.itemFilter(ids)
 			if len(ids) == 0 {
 				break
@@ -168,9 +291,17 @@ func (index *Index) QueryOptions(tags []string, start, stop int, options *IndexO
 
 // How many items have all the tags.
 func (index *Index) ItemCount(tags []string) int {
-	tags = convertTags2Simple(tags)
-	tags = index.rule.applyRulesForSearching(tags)
-	node := newIndexNode(index.What, tags, 1.0)
+	tags = index.normalizeTags(tags)
+	tags = index.currentRule().applyRulesForSearching(tags)
+	if len(tags) == 0 {
+		return 0
+	}
+	if index.RuleExpansion == RULE_EXPANSION_SEARCHING {
+		if expansions, expanded := index.expandTags(tags); expanded {
+			return index.itemCountExpanded(expansions)
+		}
+	}
+	node := index.readNode(tags)
 	return node.itemCount()
 }
 
@@ -178,9 +309,17 @@ func (index *Index) ItemCount(tags []string) int {
 // Blame my poor language, in another way:
 // Suggest a group of tags depends on a given group of tags.
 func (index *Index) RelativeTags(tags []string, count int) (relative_tags []string) {
-	tags = convertTags2Simple(tags)
-	tags = index.rule.applyRulesForSearching(tags)
-	node := newIndexNode(index.What, tags, 1.0)
+	tags = index.normalizeTags(tags)
+	tags = index.currentRule().applyRulesForSearching(tags)
+	if len(tags) == 0 {
+		return
+	}
+	if index.RuleExpansion == RULE_EXPANSION_SEARCHING {
+		if expansions, expanded := index.expandTags(tags); expanded {
+			return index.relativeTagsExpanded(expansions, count)
+		}
+	}
+	node := index.readNode(tags)
 	return node.relativeTags(count)
 }
 
@@ -195,9 +334,17 @@ func (index *Index) RelativeTagsOptions(tags []string, count int, options *Index
 
 // Suggest some tag that
 func (index *Index) RandomSuggestTags(tags []string, count int) (sugs []string) {
-	tags = convertTags2Simple(tags)
-	tags = index.rule.applyRulesForSearching(tags)
-	node := newIndexNode(index.What, tags, 1.0)
+	tags = index.normalizeTags(tags)
+	tags = index.currentRule().applyRulesForSearching(tags)
+	if len(tags) == 0 {
+		return
+	}
+	if index.RuleExpansion == RULE_EXPANSION_SEARCHING {
+		if expansions, expanded := index.expandTags(tags); expanded {
+			return index.randomSuggestTagsExpanded(expansions, count)
+		}
+	}
+	node := index.readNode(tags)
 	return node.randomSuggestTags(count)
 }
 
@@ -210,7 +357,7 @@ func (index *Index) WaitAllIndexingDone() {
 func (index *Index) workingRountine() {
 	defer func() {
 		if x := recover(); x != nil {
-			Logger.Panicln("index working routine panic:", x, string(debug.Stack()))
+			index.logger().Panicln("index working routine panic:", x, string(debug.Stack()))
 		}
 	}()
 
@@ -231,6 +378,7 @@ func (index *Index) workingRountine() {
 			if len(jobsMap) != 0 {
 				for _, op = range jobsMap {
 					index.doIndxJob(op)
+					index.markWritten()
 					index.wgDone.Done()
 				}
 				jobsMap = nil
@@ -277,28 +425,39 @@ func (idx *Index) doIndxJob(op *job) {
 }
 
 func (idx *Index) doRemoveJob(op *job) {
-	DebugLogger.Println("doRemoveJob: ", idx.What, op.id)
+	idx.debugLogger().Println("doRemoveJob: ", idx.What, op.id)
 	item := idx.ItemLoadFunc(op.id)
 	last_taginfos := idx.itemTagInfos(op.id)
+	idx.setItemDisplayForms(op.id, nil)
 
+	detaching := make([]*index_node, 0, len(last_taginfos))
 	for _, taginfo := range last_taginfos {
-		n := newIndexNode(idx.What, []string{taginfo.title}, 1.0)
-		n.detach(item)
-		n.detach_deeper(item)
+		detaching = append(detaching, newIndexNode(idx, []string{taginfo.title}, 1.0))
 		for _, alias := range taginfo.aliases {
-			n := newIndexNode(idx.What, []string{alias}, 1.0)
+			detaching = append(detaching, newIndexNode(idx, []string{alias}, 1.0))
+		}
+	}
+	// the item tags are shared by the indexes of the items, they're kept.
+	written := idx.colocated() && idx.writeItem(item, detaching, nil, nil, false)
+
+	for _, n := range detaching {
+		if !written {
 			n.detach(item)
-			n.detach_deeper(item)
 		}
+		n.detach_deeper(item)
+		idx.refreshTagDict(n)
+		idx.demotionTest(n)
 	}
+	idx.untrackCombinations(item.Id())
 }
 
 func (idx *Index) doUpdateJob(op *job) {
-	DebugLogger.Println("doUpdateJob: ", idx.What, op.id)
+	idx.debugLogger().Println("doUpdateJob: ", idx.What, op.id)
 	item := idx.ItemLoadFunc(op.id)
 
 	// load the current tags.
-	curr_tags, scores := item.TagsWithScore()
+	curr_tags, scores, originals := idx.normalizeTagsWithScore(item.TagsWithScore())
+	curr_tags, scores, originals = idx.policy.apply(curr_tags, scores, originals)
 
 	// apply rules - prepare
 	curr_taginfos := make([]*taginfo, len(curr_tags), len(curr_tags)+1)
@@ -307,13 +466,18 @@ func (idx *Index) doUpdateJob(op *job) {
 		curr_taginfos[i].title = tag
 		curr_taginfos[i].score = scores[i]
 		curr_taginfos[i].enrelative = true
+		curr_taginfos[i].display = originals[i]
 	}
 	// apply rules - whose
 	if whose_id := item.WhoseId(); whose_id != 0 {
 		curr_taginfos = append(curr_taginfos, &taginfo{title: "belongs_to:" + strconv.Itoa(int(whose_id)), score: float64(1.0), enrelative: false})
 	}
 	// apply rules - fire
-	curr_taginfos = idx.rule.applyRulesForIndexing(curr_taginfos)
+	if idx.RuleExpansion == RULE_EXPANSION_SEARCHING {
+		curr_taginfos = idx.currentRule().applyNormalizationForIndexing(curr_taginfos)
+	} else {
+		curr_taginfos = idx.currentRule().applyRulesForIndexing(curr_taginfos)
+	}
 
 	// dbgstr := make([]string, len(curr_taginfos))
 	// for i, info := range curr_taginfos {
@@ -324,12 +488,14 @@ func (idx *Index) doUpdateJob(op *job) {
 	// load item tags
 	last_tags := idx.itemTagInfos(op.id)
 
+	// figure out which to remove.
+	removing_tags := make([]*taginfo, 0, 10)
+	// the aliases no longer given by the rule to a kept tag.
+	removing_aliases := make([]string, 0, 10)
+
 	if len(last_tags) != 0 {
 		// DebugLogger.Println("doUpdateJob last_tags:", last_tags, "curr_tags", curr_taginfos)
 
-		// figure out which to remove.
-		removing_tags := make([]*taginfo, 0, 10)
-
 		sort.Sort(taginfo_title_sorter(last_tags))
 		sort.Sort(taginfo_title_sorter(curr_taginfos))
 		last_i, curr_i := 0, 0
@@ -348,6 +514,7 @@ func (idx *Index) doUpdateJob(op *job) {
 			curr_sel := curr_taginfos[curr_i]
 
 			if last_sel.title == curr_sel.title {
+				removing_aliases = append(removing_aliases, staleAliases(last_sel.aliases, curr_sel.aliases)...)
 				last_i++
 				curr_i++
 				continue
@@ -365,29 +532,50 @@ func (idx *Index) doUpdateJob(op *job) {
 			}
 		}
 
-		DebugLogger.Println("doUpdateJob removing_tags:", removing_tags)
-
-		// removing
-		for _, taginfo := range removing_tags {
-			// 1. remove basically ?
-			n := newIndexNode(idx.What, []string{taginfo.title}, 1.0)
-			n.detach(item)
+		idx.debugLogger().Println("doUpdateJob removing_tags:", removing_tags, "removing_aliases:", removing_aliases)
+	}
 
-			// 2. is there highnodes ?
-			n.detach_deeper(item)
+	// the basic nodes of the removed & the current tags, and the item tags, in one script when they're colocated.
+	detaching := make([]*index_node, 0, len(removing_tags)+len(removing_aliases))
+	for _, taginfo := range removing_tags {
+		detaching = append(detaching, newIndexNode(idx, []string{taginfo.title}, 1.0))
+		for _, alias := range taginfo.aliases {
+			detaching = append(detaching, newIndexNode(idx, []string{alias}, 1.0))
+		}
+	}
+	for _, alias := range removing_aliases {
+		detaching = append(detaching, newIndexNode(idx, []string{alias}, 1.0))
+	}
+	attaching := make([][]*index_node, len(curr_taginfos))
+	for i, taginfo := range curr_taginfos {
+		attaching[i] = append(attaching[i], newIndexNode(idx, []string{taginfo.title}, 1.0))
+		for j, alias := range taginfo.aliases {
+			attaching[i] = append(attaching[i], newIndexNode(idx, []string{alias}, taginfo.alias_scores[j]))
+		}
+	}
+	written := idx.colocated() && idx.writeItem(item, detaching, attaching, curr_taginfos, true)
 
-			// 3. aliases.
-			for _, alias := range taginfo.aliases {
-				n := newIndexNode(idx.What, []string{alias}, 1.0)
-				n.detach(item)
-				n.detach_deeper(item)
-			}
+	// removing
+	for _, n := range detaching {
+		// 1. remove basically ?
+		if !written {
+			n.detach(item)
 		}
 
+		// 2. is there highnodes ?
+		n.detach_deeper(item)
+		idx.refreshTagDict(n)
+		idx.demotionTest(n)
 	}
 
+	// from now on, the combinations of the item are registered.
+	idx.trackCombinations(item.Id())
+
 	// fill item tags:
-	idx.setItemTagInfos(op.id, curr_taginfos)
+	if !written {
+		idx.setItemTagInfos(op.id, curr_taginfos)
+	}
+	idx.setItemDisplayForms(op.id, curr_taginfos)
 
 	// updating
 
@@ -398,34 +586,24 @@ func (idx *Index) doUpdateJob(op *job) {
 	vector_count := 1
 	expd_div := make([]int, 0, len(curr_taginfos))
 	expd_mod := make([]int, 0, len(curr_taginfos))
-	for _, taginfo := range curr_taginfos {
+	for i, taginfo := range curr_taginfos {
 		high_tags := make([]string, 0, 10)
 		high_scores := make([]float64, 0, 10)
 
-		n := newIndexNode(idx.What, []string{taginfo.title}, 1.0)
-
-		n.attach(item)
-
-		if idx.updatingBombTest(n) {
-			return
-		}
-
-		if n.isHigh() {
-			high_tags = append(high_tags, taginfo.title)
-			high_scores = append(high_scores, 1.0)
-		}
-
-		for i, alias := range taginfo.aliases {
-			n := newIndexNode(idx.What, []string{alias}, taginfo.alias_scores[i])
-			n.attach(item)
+		// the title's node, then the aliases'.
+		for _, n := range attaching[i] {
+			if !written {
+				n.attach(item)
+			}
+			idx.refreshTagDict(n)
 
 			if idx.updatingBombTest(n) {
 				return
 			}
 
 			if n.isHigh() {
-				high_tags = append(high_tags, alias)
-				high_scores = append(high_scores, taginfo.alias_scores[i])
+				high_tags = append(high_tags, n.node)
+				high_scores = append(high_scores, n.tags_score)
 			}
 		}
 
@@ -439,9 +617,18 @@ func (idx *Index) doUpdateJob(op *job) {
 		}
 	}
 
+	if idx.LazyCombinations {
+		idx.attachLazyCombinations(item, curr_taginfos)
+	}
+
 	// 2. high nodes game.
 	if len(high_tags_mat) >= 2 {
+		budget := idx.newCombinationBudget()
+		defer budget.report(item)
 		for i := 0; i < vector_count; i++ {
+			if budget.exhausted() {
+				break
+			}
 			tags_vector := make([]string, len(high_tags_mat))
 			scores_vector := make([]float64, len(high_tags_mat))
 			for j := 0; j < len(high_tags_mat); j++ {
@@ -451,8 +638,10 @@ func (idx *Index) doUpdateJob(op *job) {
 			}
 			s := &updateSorter{tags: tags_vector, scores: scores_vector, en_relative_vector: en_relative_vector}
 			sort.Sort(s)
-			n := newIndexNode(idx.What, nil, 1.0)
-			idx.updatingDeeper(n, true, s.tags, s.scores, s.en_relative_vector, item)
+			if !idx.LazyCombinations {
+				n := newIndexNode(idx, nil, 1.0)
+				idx.updatingDeeper(n, true, s.tags, s.scores, s.en_relative_vector, item, budget)
+			}
 
 			// 3. Random Suggestion.
 			if i == 0 && idx.EnableRandomSuggestTags {
@@ -461,13 +650,13 @@ func (idx *Index) doUpdateJob(op *job) {
 					leng = 10
 				}
 				for i := 0; i < leng; i++ {
-					nl1 := newIndexNode(idx.What, []string{tags_vector[i]}, 1.0)
+					nl1 := newIndexNode(idx, []string{tags_vector[i]}, 1.0)
 					nl1s := make([]string, 0, leng-1)
 					for j := 0; j < i; j++ {
 						if i != j {
 							nl1s = append(nl1s, tags_vector[j])
 
-							// nl2 := newIndexNode(idx.What, []string{tags_vector[i], tags_vector[j]}, 1.0)
+							// nl2 := newIndexNode(idx, []string{tags_vector[i], tags_vector[j]}, 1.0)
 							// nl2s := make([]string, 0, leng-2)
 							// for k := 0; k < leng; k++ {
 							// 	if i != k && j != k {
@@ -484,11 +673,35 @@ func (idx *Index) doUpdateJob(op *job) {
 					}
 				}
 			}
+
+			if idx.LazyCombinations {
+				break
+			}
 		}
 	}
 
 }
 
+// the aliases in last but not in curr.
+func staleAliases(last, curr []string) (stale []string) {
+	for _, alias := range last {
+		if alias == "" {
+			continue
+		}
+		found := false
+		for _, c := range curr {
+			if alias == c {
+				found = true
+				break
+			}
+		}
+		if !found {
+			stale = append(stale, alias)
+		}
+	}
+	return
+}
+
 type updateSorter struct {
 	tags               []string
 	scores             []float64
@@ -503,11 +716,14 @@ func (s *updateSorter) Swap(i, j int) {
 }
 func (s *updateSorter) Less(i, j int) bool { return s.tags[i] < s.tags[j] }
 
-func (idx *Index) updatingDeeper(n *index_node, en_relative bool, right_tags []string, right_score []float64, en_relative_vector []bool, item Item) {
+func (idx *Index) updatingDeeper(n *index_node, en_relative bool, right_tags []string, right_score []float64, en_relative_vector []bool, item Item, budget *combinationBudget) {
 	// DebugLogger.Println("updatingDeeper:", right_tags)
 	var itemcount int
 
 	n.attach(item)
+	if len(n.tags) >= 2 {
+		n.registerCombination(item)
+	}
 
 	if en_relative {
 		itemcount = n.itemCount()
@@ -521,9 +737,13 @@ func (idx *Index) updatingDeeper(n *index_node, en_relative bool, right_tags []s
 	if n.isHigh() {
 		len_right := len(right_tags)
 		if len_right != 0 {
-			for i := 0; i < len_right; i++ {
-				next := newIndexNode(idx.What, append(n.tags, right_tags[i]), n.tags_score*right_score[i])
-				idx.updatingDeeper(next, en_relative && en_relative_vector[i], right_tags[i+1:], right_score[i+1:], en_relative_vector[i+1:], item)
+			// the tags stay sorted in the keys, but the highest scored ones go first.
+			for _, i := range scoreOrder(right_score) {
+				if !budget.allow(len(n.tags) + 1) {
+					break
+				}
+				next := newIndexNode(idx, append(n.tags, right_tags[i]), n.tags_score*right_score[i])
+				idx.updatingDeeper(next, en_relative && en_relative_vector[i], right_tags[i+1:], right_score[i+1:], en_relative_vector[i+1:], item, budget)
 			}
 		}
 	}
@@ -535,7 +755,7 @@ func (idx *Index) updatingDeeper(n *index_node, en_relative bool, right_tags []s
 			copy(curr, n.tags[1:])
 			for i := 0; i < lentags; i++ {
 				// DebugLogger.Println("setRelativeTags:", i, curr, n.tags[i], n.tags)
-				nr := newIndexNode(idx.What, curr, 1.0)
+				nr := newIndexNode(idx, curr, 1.0)
 				nr.setRelativeTags(n.tags[i], itemcount)
 				if i != lentags-1 {
 					curr[i] = n.tags[i]
@@ -545,69 +765,86 @@ func (idx *Index) updatingDeeper(n *index_node, en_relative bool, right_tags []s
 	}
 }
 
+// a node reaching its boundary becomes high, and the job is redone with the combinations built: returns true.
 func (idx *Index) updatingBombTest(n *index_node) bool {
-	if n.itemCount() == idx.HighNodeBoundary && !n.isHigh() {
-		n.setHigh()
-		ids := n.items()
-		idx.wgDone.Add(len(ids))
-		Logger.Println("A new high tag:", idx.What, n.tags)
-		Logger.Println("Affected items:", idx.What, "ids:", ids)
-		go func() {
-			for _, id := range ids {
-				idx.chOp <- &job{id: id}
-			}
-		}()
-		go func() {
-			if HighTagNofityFunc != nil {
-				HighTagNofityFunc(n.tags)
-			}
-		}()
-		return true
+	return idx.promotionTest(n) && idx.rebuildCombinations(n)
+}
+
+func (idx *Index) promotionTest(n *index_node) bool {
+	if n.isHigh() || n.itemCount() < idx.highBoundary(n) {
+		return false
+	}
+	n.setHigh()
+	idx.logger().Println("A new high tag:", idx.What, n.tags)
+	go idx.notifyHigh(n.tags)
+	return true
+}
+
+// reindex the items of a new high node to build its combinations, false with LazyCombinations: they're built on queries.
+func (idx *Index) rebuildCombinations(n *index_node) bool {
+	if idx.LazyCombinations {
+		return false
 	}
-	return false
+	ids := n.items()
+	idx.wgDone.Add(len(ids))
+	idx.logger().Println("Affected items:", idx.What, "ids:", ids)
+	go func() {
+		for _, id := range ids {
+			idx.chOp <- &job{id: id}
+		}
+	}()
+	return true
 }
 
 func (idx *Index) itemTagInfos(id uint64) []*taginfo {
-	key := const_key_item_tag_hash + strconv.Itoa(int(id))
-	c := GetReadConn(int(id))
+	key := idx.itemKey(const_key_item_tag_hash, id)
+	c := idx.primaryConn(idx.id2shard(id))
 	defer c.Close()
 	vals, _ := redis.Values(c.Do("HGETALL", key))
 	fields := make([]string, len(vals))
-	ast(redis.ScanSlice(vals, &fields))
+	idx.ast(redis.ScanSlice(vals, &fields))
 	ret := make([]*taginfo, len(fields)/2)
 	for i := 0; i < len(fields); i += 2 {
 		x := &taginfo{}
 		x.title = fields[i]
-		x.aliases = strings.Split(fields[i+1], const_tags_separator)
+		x.aliases = splitTags(fields[i+1])
 		ret[i/2] = x
 	}
 	return ret
 }
 
 func (idx *Index) setItemTagInfos(id uint64, infos []*taginfo) {
-	c := GetWriteConn(int(id))
+	c := idx.writeConn(idx.id2shard(id))
 	defer c.Close()
 
-	key := const_key_item_tag_hash + strconv.Itoa(int(id))
+	key := idx.itemKey(const_key_item_tag_hash, id)
+
+	args := []interface{}{key}
+	for _, info := range infos {
+		args = append(args, info.title, joinTags(info.aliases, const_tags_separator))
+	}
+	if idx.runScript(c, itemTagInfosScript, args...) {
+		return
+	}
 
 	c.Send("DEL", key)
 	for _, info := range infos {
-		ast(c.Send("HSET", key, info.title, strings.Join(info.aliases, const_tags_separator)))
+		idx.ast(c.Send("HSET", key, info.title, joinTags(info.aliases, const_tags_separator)))
 	}
-	ast(c.Flush())
-	ast2(c.Receive())
+	idx.ast(c.Flush())
+	idx.ast2(c.Receive())
 	for i := 0; i < len(infos); i++ {
-		ast2(c.Receive())
+		idx.ast2(c.Receive())
 	}
 }
 
 func (idx *Index) node_str(key string, tags []string) string {
-	return idx.What + key + strings.Join(tags, const_tags_separator)
+	return idx.What + key + idx.hashTag(joinTags(tags, const_tags_separator))
 }
 
 // info of a tag index node.
 type index_node struct {
-	what       string
+	idx        *Index
 	tags_score float64
 	tags       []string
 
@@ -615,24 +852,34 @@ type index_node struct {
 	node  string
 	exist *bool
 	shard int
+
+	// the connection to read, the primary if nil.
+	read GetRedisConnFuncType
 }
 
-func newIndexNode(what string, tags []string, tags_score float64) (node *index_node) {
-	node = &index_node{what: what, tags: tags, tags_score: tags_score}
+func newIndexNode(idx *Index, tags []string, tags_score float64) (node *index_node) {
+	node = &index_node{idx: idx, tags: tags, tags_score: tags_score}
 	if node.node == "" {
 		sort.Strings(tags)
-		node.node = strings.Join(tags, const_tags_separator)
-		node.shard = int(adler32.Checksum([]byte(node.node))) //TODO:
+		node.node = joinTags(tags, const_tags_separator)
+		node.shard = idx.str2shard(node.node)
 	}
 	return node
 }
 
+func (node *index_node) readConn() redis.Conn {
+	if node.read != nil {
+		return node.read(node.shard)
+	}
+	return node.idx.primaryConn(node.shard)
+}
+
 func (node *index_node) idstr(str string) string {
-	return node.what + str + node.node
+	return node.idx.What + str + node.idx.hashTag(node.node)
 }
 
 func (node *index_node) attach(item Item) {
-	c := GetWriteConn(node.shard)
+	c := node.idx.writeConn(node.shard)
 	defer c.Close()
 
 	// variables
@@ -640,6 +887,10 @@ func (node *index_node) attach(item Item) {
 	item_score := item.Score()
 	item_date := item.CreateDate()
 
+	if node.idx.runScript(c, attachScript, append(node.rankKeys(), item_id, item_score, item_date, fade_score(item_score*node.tags_score, item_date))...) {
+		return
+	}
+
 	// base set
 	c.Send("SADD", node.idstr(const_key_idx_base_set), item_id)
 
@@ -653,67 +904,65 @@ func (node *index_node) attach(item Item) {
 	c.Send("ZADD", node.idstr(const_key_idx_overall_rank), fade_score(item_score*node.tags_score, item_date), item_id)
 
 	c.Flush()
-	ast2(c.Receive())
-	ast2(c.Receive())
-	ast2(c.Receive())
-	ast2(c.Receive())
+	node.idx.ast2(c.Receive())
+	node.idx.ast2(c.Receive())
+	node.idx.ast2(c.Receive())
+	node.idx.ast2(c.Receive())
 }
 
 func (node *index_node) detach(item Item) {
-	c := GetWriteConn(node.shard)
+	c := node.idx.writeConn(node.shard)
 	defer c.Close()
 
 	item_id := item.Id()
 
+	if node.idx.runScript(c, detachScript, append(node.rankKeys(), item_id)...) {
+		return
+	}
+
 	c.Send("SREM", node.idstr(const_key_idx_base_set), item_id)
 	c.Send("ZREM", node.idstr(const_key_idx_score_rank), item_id)
 	c.Send("ZREM", node.idstr(const_key_idx_date_rank), item_id)
 	c.Send("ZREM", node.idstr(const_key_idx_overall_rank), item_id)
 	c.Flush()
-	ast2(c.Receive())
-	ast2(c.Receive())
-	ast2(c.Receive())
-	ast2(c.Receive())
+	node.idx.ast2(c.Receive())
+	node.idx.ast2(c.Receive())
+	node.idx.ast2(c.Receive())
+	node.idx.ast2(c.Receive())
 }
 
-func (node *index_node) detach_deeper(item Item) {
+// the way before the combination registry: scan the high nodes of all the shards for the ones with node.tags in.
+func (node *index_node) detach_deeper_scan(item Item) {
 	// find nodes and kill the all.
-	item_id := item.Id()
 	wg := &sync.WaitGroup{}
-	wg.Add(RedisShardMax)
-	for i := 0; i < RedisShardMax; i++ {
+	wg.Add(node.idx.shardCount())
+	for i := 0; i < node.idx.shardCount(); i++ {
 		go func(shard int) {
-			c := GetWriteConn(shard)
+			c := node.idx.writeConn(shard)
 			defer c.Close()
 			pattern := "*"
-			pattern += strings.Join(node.tags, "*")
+			pattern += joinTags(node.tags, "*")
 			pattern += "*"
 
 			cursor := "0"
 			nodes := make([]string, 0, 10)
 			for {
-				vals, _ := redis.Values(ast2(c.Do("SSCAN", const_key_high_tags_set+node.what, cursor, "MATCH", pattern)))
+				vals, _ := redis.Values(node.idx.ast2(c.Do("SSCAN", const_key_high_tags_set+node.idx.What, cursor, "MATCH", pattern)))
 				cursor = string(vals[0].([]byte))
 				for _, ikey := range vals[1].([]interface{}) {
-					nodes = append(nodes, string(ikey.([]byte)))
+					// the pattern matches substrings, keep the nodes really having the tags.
+					if n := string(ikey.([]byte)); containsTags(splitTags(n), node.tags) {
+						nodes = append(nodes, n)
+					}
 				}
 				if cursor == "0" {
 					break
 				}
 			}
 
+			// the nodes are on their own shards.
 			for _, n := range nodes {
-				c.Send("SREM", node.what+const_key_idx_base_set+n, item_id)
-				c.Send("ZREM", node.what+const_key_idx_score_rank+n, item_id)
-				c.Send("ZREM", node.what+const_key_idx_date_rank+n, item_id)
-				c.Send("ZREM", node.what+const_key_idx_overall_rank+n, item_id)
-			}
-			c.Flush()
-			for i := 0; i < len(nodes); i++ {
-				ast2(c.Receive())
-				ast2(c.Receive())
-				ast2(c.Receive())
-				ast2(c.Receive())
+				newIndexNode(node.idx, splitTags(n), 1.0).detach(item)
 			}
 			wg.Done()
 		}(i)
@@ -723,18 +972,18 @@ func (node *index_node) detach_deeper(item Item) {
 
 func (node *index_node) exists() bool {
 	if node.exist == nil {
-		c := GetReadConn(node.shard)
+		c := node.readConn()
 		defer c.Close()
-		exist, _ := redis.Bool(ast2(c.Do("EXISTS", node.idstr(const_key_idx_base_set))))
+		exist, _ := redis.Bool(node.idx.ast2(c.Do("EXISTS", node.idstr(const_key_idx_base_set))))
 		node.exist = &exist
 	}
 	return *node.exist
 }
 
 func (node *index_node) itemCount() int {
-	c := GetReadConn(node.shard)
+	c := node.readConn()
 	defer c.Close()
-	count, _ := redis.Int(ast2(c.Do("SCARD", node.idstr(const_key_idx_base_set))))
+	count, _ := redis.Int(node.idx.ast2(c.Do("SCARD", node.idstr(const_key_idx_base_set))))
 	return count
 }
 
@@ -742,16 +991,16 @@ func (node *index_node) items() (ids []uint64) {
 	if !node.exists() {
 		return nil
 	}
-	c := GetReadConn(node.shard)
+	c := node.readConn()
 	defer c.Close()
 	vals, _ := redis.Values(c.Do("SMEMBERS", node.idstr(const_key_idx_base_set)))
 	ids = make([]uint64, len(vals))
-	ast(redis.ScanSlice(vals, &ids))
+	node.idx.ast(redis.ScanSlice(vals, &ids))
 	return
 }
 
 func (node *index_node) itemFilter(subjects []uint64) (confirmed_ids []uint64) {
-	c := GetReadConn(node.shard)
+	c := node.readConn()
 	defer c.Close()
 	key := node.idstr(const_key_idx_base_set)
 	for _, id := range subjects {
@@ -759,7 +1008,7 @@ func (node *index_node) itemFilter(subjects []uint64) (confirmed_ids []uint64) {
 	}
 	c.Flush()
 	for _, id := range subjects {
-		if exists, _ := redis.Bool(ast2(c.Receive())); exists {
+		if exists, _ := redis.Bool(node.idx.ast2(c.Receive())); exists {
 			confirmed_ids = append(confirmed_ids, id)
 		}
 	}
@@ -775,76 +1024,66 @@ func (node *index_node) itemsRevrange(sorting_key string, start, stop int) (ids
 }
 
 func (node *index_node) itemsWith(cmd, sorting_key string, start, stop int) (ids []uint64) {
-	c := GetReadConn(node.shard)
+	c := node.readConn()
 	defer c.Close()
 	key := node.idstr(sorting_key)
-	vals, _ := redis.Values(ast2(c.Do(cmd, key, start, stop)))
+	vals, _ := redis.Values(node.idx.ast2(c.Do(cmd, key, start, stop)))
 	ids = make([]uint64, len(vals))
-	ast(redis.ScanSlice(vals, &ids))
+	node.idx.ast(redis.ScanSlice(vals, &ids))
 	return
 }
 
 func (node *index_node) setRelativeTags(tag string, times int) {
 	if strings.HasPrefix(tag, "belongs_to") {
-		Logger.Println("debug: setRelativeTags with belongs_to bug exists!")
+		node.idx.logger().Println("debug: setRelativeTags with belongs_to bug exists!")
 		return
 	}
 
 	// DebugLogger.Println("setRelativeTags:", node.tags, "to:", tag, "times", times)
-	c := GetWriteConn(node.shard)
+	c := node.idx.writeConn(node.shard)
 	defer c.Close()
-	ast2(c.Do("ZADD", node.idstr(const_key_idx_relative_rank), times, tag))
+	node.idx.ast2(c.Do("ZADD", node.idstr(const_key_idx_relative_rank), times, tag))
 }
 
 func (node *index_node) relativeTags(count int) []string {
-	c := GetReadConn(node.shard)
+	c := node.readConn()
 	defer c.Close()
-	rels, _ := redis.Strings(ast2(c.Do("ZREVRANGE", node.idstr(const_key_idx_relative_rank), 0, count-1)))
+	rels, _ := redis.Strings(node.idx.ast2(c.Do("ZREVRANGE", node.idstr(const_key_idx_relative_rank), 0, count-1)))
 	return rels
 }
 
 func (node *index_node) addRandomSuggestTags(tags []string) {
-	c := GetWriteConn(node.shard)
+	c := node.idx.writeConn(node.shard)
 	defer c.Close()
 	args := make([]interface{}, len(tags)+1)
 	args[0] = interface{}(node.idstr(const_key_idx_rand_sug_set))
 	for i, tag := range tags {
 		args[i] = interface{}(tag)
 	}
-	ast2(c.Do("SADD", args...))
+	node.idx.ast2(c.Do("SADD", args...))
 }
 
 func (node *index_node) randomSuggestTags(count int) []string {
-	c := GetReadConn(node.shard)
+	c := node.readConn()
 	defer c.Close()
-	rels, _ := redis.Strings(ast2(c.Do("SRANDMEMBER", node.idstr(const_key_idx_rand_sug_set), count)))
+	rels, _ := redis.Strings(node.idx.ast2(c.Do("SRANDMEMBER", node.idstr(const_key_idx_rand_sug_set), count)))
 	return rels
 }
 
 func (node *index_node) setHigh() {
-	c := GetWriteConn(node.shard)
+	c := node.idx.writeConn(node.idx.highTagsShard(node.shard))
 	defer c.Close()
-	ast2(c.Do("SADD", const_key_high_tags_set+node.what, node.node))
+	node.idx.ast2(c.Do("SADD", const_key_high_tags_set+node.idx.What, node.node))
 }
 
 func (node *index_node) isHigh() bool {
-	c := GetReadConn(node.shard)
+	c := node.idx.primaryConn(node.idx.highTagsShard(node.shard))
 	defer c.Close()
-	ret, _ := redis.Bool(ast2(c.Do("SISMEMBER", const_key_high_tags_set+node.what, node.node)))
+	ret, _ := redis.Bool(node.idx.ast2(c.Do("SISMEMBER", const_key_high_tags_set+node.idx.What, node.node)))
 	return ret
 }
 
 // some helper functions below for keeping the code short.
-func str2shard(str string) int {
-	return int(adler32.Checksum([]byte(str)))
-}
-
-func convertTags2Simple(tags []string) []string {
-	for i, tag := range tags {
-		tags[i] = gozhszht.ToSimple(tag)
-	}
-	return tags
-}
 
 func must(exp bool, what ...interface{}) {
 	if exp == false {
@@ -870,3 +1109,23 @@ func ast2(dontcare interface{}, err error) (interface{}, error) {
 	}
 	return dontcare, nil
 }
+
+// must, ast & ast2 panicking through the logger of the index, the ones above are for the package-level callers.
+func (idx *Index) must(exp bool, what ...interface{}) {
+	if exp == false {
+		idx.logger().Panicln(what...)
+	}
+}
+
+func (idx *Index) ast(err error) {
+	if err != nil {
+		idx.logger().Panicln(err)
+	}
+}
+
+func (idx *Index) ast2(dontcare interface{}, err error) (interface{}, error) {
+	if err != nil {
+		idx.logger().Panicln(err)
+	}
+	return dontcare, nil
+}
@@ -63,6 +63,12 @@ var (
 		12: &testItem{12, 12, []string{"B", "A", "C", "住宿"}, []float64{1.0, 0.8, 0.6, 0.1}, 3},
 
 		13: &testItem{12, 12, []string{"红墨咖啡", "鼓浪屿", "推荐", "客栈", "住", "酒店", "杨桃院子"}, []float64{1.0, 1.0, 1.0, 1.0, 1.0, 1.0, 1.0}, 4},
+
+		14: &testItem{14, 14, []string{"Go"}, nil, 0},
+		15: &testItem{15, 15, []string{"Go", "x"}, nil, 0},
+		16: &testItem{16, 16, []string{"go"}, nil, 0},
+
+		17: &testItem{17, 17, []string{"plain", "a*"}, nil, 0},
 	}
 )
 
@@ -118,6 +124,8 @@ func TestIndex3(t *testing.T) {
 	initTest(5)
 	ids := idx.Query([]string{"好吃"}, 0, 9)
 	must(len(ids) == 2 && ids[0] == 5 && ids[1] == 4, "Search result:", ids)
+	ids = idx.Query([]string{"好吃"}, 0, -1)
+	must(len(ids) == 2 && ids[0] == 5 && ids[1] == 4, "Search result (0, -1):", ids)
 }
 
 // Entanglement
@@ -168,9 +176,177 @@ func TestIndex7(t *testing.T) {
 	ids = idx.Query([]string{"C"}, 0, 9)
 	must(len(ids) == 2 && ids[0] == 11 && ids[1] == 10, "Search result:", ids)
 
+	// the emptied combination nodes are unregistered.
+	for _, tag := range []string{"C", "住宿"} {
+		for _, combination := range idx.combinationsOfTag(tag) {
+			n := newIndexNode(idx, splitTags(combination), 1.0)
+			must(n.itemCount() > 0, "Empty combination registered:", combination)
+		}
+	}
 }
 
 // Bug
 func TestIndex8(t *testing.T) {
 	initTest(13)
 }
+
+// Autocomplete
+func TestIndex9(t *testing.T) {
+	initTest(12)
+	tags := idx.Autocomplete("a", 3)
+	must(len(tags) == 3 && tags[0] == "ab1" && tags[1] == "a1" && tags[2] == "a2", "Autocomplete result:", tags)
+	tags = idx.Autocomplete("好", 3)
+	must(len(tags) == 0, "Autocomplete result:", tags)
+}
+
+// Autocomplete by pinyin
+func TestIndex10(t *testing.T) {
+	initTest(12)
+	tags := idx.Autocomplete("zs", 3)
+	must(len(tags) == 1 && tags[0] == "住宿", "Autocomplete result:", tags)
+	tags = idx.Autocomplete("zhu", 3)
+	must(len(tags) == 1 && tags[0] == "住宿", "Autocomplete result:", tags)
+}
+
+// Fuzzy query
+func TestIndex11(t *testing.T) {
+	initTest(12)
+	ids, corrections := idx.QueryFuzzy([]string{" ａ1"}, 0, 9, &IndexOptions{SortBy: SORT_BY_OVERALL})
+	must(len(ids) == 1 && ids[0] == 1, "Search result:", ids)
+	must(len(corrections) == 1 && corrections[0].To == "a1" && corrections[0].Distance == 0, "Corrections:", corrections)
+
+	idx.FuzzyDistance = 1
+	defer func() { idx.FuzzyDistance = 0 }()
+	tags, corrections := idx.CorrectTags([]string{"abc9", "A"})
+	must(tags[0] == "abc1" && tags[1] == "A" && len(corrections) == 1 && corrections[0].Distance == 1, "Corrections:", tags, corrections)
+}
+
+// Normalizers & display forms
+func TestIndex12(t *testing.T) {
+	idx.Normalizers = []Normalizer{NormalizeTrim, NormalizeCase}
+	defer func() { idx.Normalizers = nil }()
+
+	initTest(0)
+	idx.Update(14)
+	idx.Update(15)
+	idx.Update(16)
+	idx.WaitAllIndexingDone()
+
+	ids := idx.Query([]string{" GO "}, 0, 9)
+	must(len(ids) == 3, "Search result:", ids)
+	forms := idx.DisplayForms([]string{"go", "x"})
+	must(forms[0] == "Go" && forms[1] == "x", "Display forms:", forms)
+}
+
+// Rule reloading
+func TestIndex13(t *testing.T) {
+	initTest(5)
+	defer func() {
+		idx.SetRule(dummyRule())
+		idx.WaitAllIndexingDone()
+	}()
+
+	rt := dummyRule()
+	rt.Containing["美食"] = []string{"甜点", "西餐"}
+	diags := idx.SetRule(rt)
+	must(len(diags) == 0, "SetRule:", diags)
+	idx.WaitAllIndexingDone()
+
+	ids := idx.Query([]string{"美食"}, 0, 9)
+	must(len(ids) == 1 && ids[0] == 4, "Search result:", ids)
+
+	rt.Containing["小吃"] = []string{"美食"}
+	rt.Containing["美食"] = []string{"小吃"}
+	diags = idx.SetRule(rt)
+	must(len(diags) == 1 && diags[0].Problem == RULE_PROBLEM_CONTAINING_CYCLE, "SetRule:", diags)
+}
+
+// Search time rule expansion
+func TestIndex14(t *testing.T) {
+	idx.RuleExpansion = RULE_EXPANSION_SEARCHING
+	defer func() { idx.RuleExpansion = RULE_EXPANSION_INDEXING }()
+
+	initTest(6)
+	ids := idx.Query([]string{"好吃"}, 0, 9)
+	must(len(ids) == 2 && ids[0]+ids[1] == 9, "Search result:", ids)
+	ids = idx.Query([]string{"好吃"}, 0, -1)
+	must(len(ids) == 2 && ids[0]+ids[1] == 9, "Search result (0, -1):", ids)
+	must(idx.ItemCount([]string{"美食"}) == 2, "Item count:", idx.ItemCount([]string{"美食"}))
+	ids = idx.Query([]string{"自行车"}, 0, 9)
+	must(len(ids) == 1 && ids[0] == 6, "Search result:", ids)
+	ids = idx.Query([]string{"美食", "b2"}, 0, 9)
+	must(len(ids) == 1 && ids[0] == 5, "Search result:", ids)
+}
+
+// High node demotion
+func TestIndex15(t *testing.T) {
+	idx.HighNodeLowBoundary = 2
+	defer func() { idx.HighNodeLowBoundary = 0 }()
+
+	initTest(12)
+	n := newIndexNode(idx, []string{"C"}, 1.0)
+	must(n.isHigh(), "C should be high")
+
+	idx.Remove(10)
+	idx.Remove(11)
+	idx.WaitAllIndexingDone()
+
+	must(!n.isHigh(), "C should be demoted")
+	must(len(idx.combinationsOfTag("C")) == 0, "Deeper nodes:", idx.combinationsOfTag("C"))
+	for _, sibling := range []string{"A", "B"} {
+		for _, tag := range idx.RelativeTags([]string{sibling}, 100) {
+			must(tag != "C", "C is still relative to", sibling)
+		}
+	}
+	ids := idx.Query([]string{"C"}, 0, 9)
+	must(len(ids) == 1 && ids[0] == 12, "Search result:", ids)
+	ids = idx.Query([]string{"A", "C"}, 0, 9)
+	must(len(ids) == 1 && ids[0] == 12, "Search result:", ids)
+}
+
+// Lazy combinations
+func TestIndex16(t *testing.T) {
+	idx.LazyCombinations = true
+	idx.LazyCombinationQueries = 2
+	defer func() { idx.LazyCombinations = false; idx.LazyCombinationQueries = 0 }()
+
+	initTest(10)
+	ids := idx.Query([]string{"A", "C"}, 0, 9)
+	must(len(ids) == 1 && !newIndexNode(idx, []string{"A", "C"}, 1.0).exists(), "Search result:", ids)
+	ids = idx.Query([]string{"A", "C"}, 0, 9)
+	must(len(ids) == 1 && ids[0] == 10, "Search result:", ids)
+	must(newIndexNode(idx, []string{"A", "C"}, 1.0).exists(), "A|C should be materialized")
+
+	// kept up to date.
+	idx.Update(11)
+	idx.WaitAllIndexingDone()
+	ids = idx.Query([]string{"A", "C"}, 0, 9)
+	must(len(ids) == 2 && ids[0] == 11 && ids[1] == 10, "Search result:", ids)
+
+	idx.Remove(11)
+	idx.WaitAllIndexingDone()
+	ids = idx.Query([]string{"A", "C"}, 0, 9)
+	must(len(ids) == 1 && ids[0] == 10, "Search result:", ids)
+}
+
+// Migrating the tag keys leaves the display counts of the plain tags alone
+func TestIndex17(t *testing.T) {
+	initTest(0)
+	idx.Update(17)
+	idx.WaitAllIndexingDone()
+
+	n := newIndexNode(idx, []string{"plain"}, 1.0)
+	count := func() float64 {
+		c := getTestConn(0)
+		defer c.Close()
+		count, _ := redis.Float64(c.Do("ZSCORE", n.idstr(const_key_tag_display_rank), "plain"))
+		return count
+	}
+	must(count() == 1, "Display count:", count())
+
+	must(idx.MigrateTagKeys() == 1, "Migrated items")
+	idx.WaitAllIndexingDone()
+	must(count() == 1, "Display count after migrating:", count())
+	ids := idx.Query([]string{"a*"}, 0, 9)
+	must(len(ids) == 1 && ids[0] == 17, "Search result:", ids)
+}
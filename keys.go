@@ -0,0 +1,243 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Tags in keys: a tag is escaped before it's joined into a node key or a MATCH pattern, so a tag with the separator
+// or a glob character in it can't change the node it stands for, or match nodes it's not in.
+// The braces are escaped too, they'd cut the hash tag of the key short with RedisCluster.
+// The escaping is reversible, and a tag without any of the characters is kept as it is.
+const (
+	const_key_escape       = '%'
+	const_key_escape_chars = "%|*?[]\\^{}"
+)
+
+func escapeTag(tag string) string {
+	if !strings.ContainsAny(tag, const_key_escape_chars) {
+		return tag
+	}
+	buf := make([]byte, 0, len(tag)+8)
+	for i := 0; i < len(tag); i++ {
+		if strings.IndexByte(const_key_escape_chars, tag[i]) >= 0 {
+			buf = append(buf, const_key_escape, "0123456789ABCDEF"[tag[i]>>4], "0123456789ABCDEF"[tag[i]&15])
+		} else {
+			buf = append(buf, tag[i])
+		}
+	}
+	return string(buf)
+}
+
+func unescapeTag(s string) string {
+	if strings.IndexByte(s, const_key_escape) < 0 {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == const_key_escape && i+2 < len(s) {
+			if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				buf = append(buf, byte(b))
+				i += 2
+				continue
+			}
+		}
+		buf = append(buf, s[i])
+	}
+	return string(buf)
+}
+
+// join the escaped tags.
+func joinTags(tags []string, sep string) string {
+	escaped := make([]string, len(tags))
+	for i, tag := range tags {
+		escaped[i] = escapeTag(tag)
+	}
+	return strings.Join(escaped, sep)
+}
+
+// the reverse of joinTags with const_tags_separator.
+func splitTags(s string) []string {
+	tags := strings.Split(s, const_tags_separator)
+	for i, tag := range tags {
+		tags[i] = unescapeTag(tag)
+	}
+	return tags
+}
+
+// Migrate the data written before the tags were escaped in keys:
+// the items with a tag needing escaping have their old nodes dropped, and their item records rewritten,
+// then they're reindexed under the escaped keys, with the items of the dropped high nodes.
+// The other items are left alone, their keys didn't change.
+// Returns how many items are reindexed, call WaitAllIndexingDone to wait for them.
+func (index *Index) MigrateTagKeys() (items int) {
+	affected := make(map[uint64][]*taginfo)
+	specials := make(map[string]bool)
+
+	// 1. the item records in the old format, of the items in this index.
+	mu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	conns := index.keyspaceConns()
+	wg.Add(len(conns))
+	for _, c := range conns {
+		go func(c redis.Conn) {
+			defer wg.Done()
+			defer c.Close()
+			scanKeys(c, "SCAN", "", const_key_item_tag_hash+"*", func(key string) {
+				id, err := parseItemKey(const_key_item_tag_hash, key)
+				if err != nil {
+					return
+				}
+				vals, _ := redis.StringMap(index.ast2(c.Do("HGETALL", key)))
+				infos := make([]*taginfo, 0, len(vals))
+				special := make([]string, 0)
+				for title, aliases := range vals {
+					info := &taginfo{title: title, aliases: strings.Split(aliases, const_tags_separator)}
+					for _, tag := range append([]string{title}, info.aliases...) {
+						if escapeTag(tag) != tag {
+							special = append(special, tag)
+						}
+					}
+					infos = append(infos, info)
+				}
+				if len(special) == 0 || !index.hasOldItem(id, infos) {
+					return
+				}
+				mu.Lock()
+				affected[id] = infos
+				for _, tag := range special {
+					specials[tag] = true
+				}
+				mu.Unlock()
+			})
+		}(c)
+	}
+	wg.Wait()
+
+	if len(affected) == 0 {
+		return 0
+	}
+	index.logger().Println("MigrateTagKeys:", index.What, "tags:", len(specials), "items:", len(affected))
+
+	// 2. the old basic nodes of the tags.
+	for tag := range specials {
+		c := index.writeConn(index.str2shard(tag))
+		for _, key := range []string{const_key_idx_base_set, const_key_idx_score_rank, const_key_idx_date_rank, const_key_idx_overall_rank,
+			const_key_idx_relative_rank, const_key_idx_rand_sug_set, const_key_tag_display_rank} {
+			index.ast2(c.Do("DEL", index.What+key+tag))
+		}
+		c.Close()
+	}
+
+	// 3. the old high nodes with the tags in, their items are reindexed too.
+	reindexing := make(map[uint64]bool)
+	for i := 0; i < index.shardCount(); i++ {
+		c := index.writeConn(i)
+		stale := make([]string, 0)
+		scanKeys(c, "SSCAN", const_key_high_tags_set+index.What, "*", func(member string) {
+			for tag := range specials {
+				if oldNodeHasTag(member, tag) {
+					stale = append(stale, member)
+					break
+				}
+			}
+		})
+		for _, member := range stale {
+			index.ast2(c.Do("SREM", const_key_high_tags_set+index.What, member))
+			cn := index.writeConn(index.str2shard(member))
+			ids, _ := redis.Values(index.ast2(cn.Do("SMEMBERS", index.What+const_key_idx_base_set+member)))
+			for _, v := range ids {
+				if id, err := redis.Uint64(v, nil); err == nil {
+					reindexing[id] = true
+				}
+			}
+			for _, key := range []string{const_key_idx_base_set, const_key_idx_score_rank, const_key_idx_date_rank, const_key_idx_overall_rank,
+				const_key_idx_relative_rank, const_key_idx_rand_sug_set} {
+				index.ast2(cn.Do("DEL", index.What+key+member))
+			}
+			cn.Close()
+			for _, tag := range strings.Split(member, const_tags_separator) {
+				cn := index.writeConn(index.str2shard(escapeTag(tag)))
+				index.ast2(cn.Do("SREM", index.tagCombinationKey(tag), member))
+				cn.Close()
+			}
+		}
+		c.Close()
+	}
+
+	// 4. rewrite the item records in the new format, and reindex.
+	// The display records of the special tags are dropped with their old counts in 2, so they're counted again,
+	// the other ones are kept as their counts are.
+	for id, infos := range affected {
+		index.setItemTagInfos(id, infos)
+		args := []interface{}{index.itemDisplayKey(id)}
+		for _, info := range infos {
+			if specials[info.title] {
+				args = append(args, info.title)
+			}
+		}
+		if len(args) > 1 {
+			c := index.writeConn(index.id2shard(id))
+			index.ast2(c.Do("HDEL", args...))
+			c.Close()
+		}
+		reindexing[id] = true
+	}
+	for id := range reindexing {
+		index.Update(id)
+	}
+	return len(reindexing)
+}
+
+// is the item in the index: in the old basic node of one of its tags.
+// The item records aren't per index, the ones of the other indexes are left alone.
+func (idx *Index) hasOldItem(id uint64, infos []*taginfo) bool {
+	for _, info := range infos {
+		for _, tag := range append([]string{info.title}, info.aliases...) {
+			if tag == "" {
+				continue
+			}
+			c := idx.primaryConn(idx.str2shard(tag))
+			in, _ := redis.Bool(idx.ast2(c.Do("SISMEMBER", idx.What+const_key_idx_base_set+tag, id)))
+			c.Close()
+			if in {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// is the tag one of the tags of the old node, joined without escaping ?
+// A tag with the separator in can't be told from the tags around it, those nodes are dropped too.
+func oldNodeHasTag(member, tag string) bool {
+	parts, tag_parts := strings.Split(member, const_tags_separator), strings.Split(tag, const_tags_separator)
+	for i := 0; i+len(tag_parts) <= len(parts); i++ {
+		if strings.Join(parts[i:i+len(tag_parts)], const_tags_separator) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// SCAN / SSCAN through all the keys / members matching the pattern.
+func scanKeys(c redis.Conn, cmd, key, pattern string, fn func(string)) {
+	cursor := "0"
+	for {
+		args := []interface{}{cursor, "MATCH", pattern}
+		if key != "" {
+			args = append([]interface{}{key}, args...)
+		}
+		vals, _ := redis.Values(ast2(c.Do(cmd, args...)))
+		cursor = string(vals[0].([]byte))
+		members, _ := redis.Strings(vals[1], nil)
+		for _, member := range members {
+			fn(member)
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package tagstack
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEscapeTag(t *testing.T) {
+	for _, tag := range []string{"A", "鼓浪屿", "a|b", "c*", "[x]?", "100%", "%7C", "a\\b^", "}a", "{x}"} {
+		escaped := escapeTag(tag)
+		must(!strings.ContainsAny(escaped, "|*?[]\\^{}"), "escaped:", escaped)
+		must(unescapeTag(escaped) == tag, "unescape:", tag, escaped, unescapeTag(escaped))
+	}
+	must(escapeTag("鼓浪屿") == "鼓浪屿", "escape changed a plain tag")
+
+	tags := splitTags(joinTags([]string{"a|b", "c", ""}, const_tags_separator))
+	must(len(tags) == 3 && tags[0] == "a|b" && tags[1] == "c" && tags[2] == "", "splitTags:", tags)
+
+	// "A|B" as one tag is not the node of "A" & "B".
+	must(newIndexNode(&Index{What: "t."}, []string{"A|B"}, 1.0).node != newIndexNode(&Index{What: "t."}, []string{"A", "B"}, 1.0).node, "node collision")
+
+	// the old nodes, joined without escaping.
+	must(oldNodeHasTag("a*|b", "a*") && oldNodeHasTag("c|a*", "a*"), "oldNodeHasTag")
+	must(!oldNodeHasTag("a*b|c", "a*") && !oldNodeHasTag("xa*|c", "a*"), "oldNodeHasTag: not a whole tag")
+	must(oldNodeHasTag("a|b|c", "b|c") && !oldNodeHasTag("a|bc", "b|c"), "oldNodeHasTag: a tag with the separator")
+}
@@ -0,0 +1,246 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"time"
+)
+
+const (
+	// the query counts of the combinations not materialized yet, for LazyCombinations.
+	const_key_lazy_query_count = "tlzq."
+
+	// the default LazyCombinationTTL.
+	const_lazy_combination_ttl = time.Hour
+)
+
+func (idx *Index) lazyTTL() int {
+	if idx.LazyCombinationTTL > 0 {
+		return int(idx.LazyCombinationTTL / time.Second)
+	}
+	return int(const_lazy_combination_ttl / time.Second)
+}
+
+// count a query of a missing combination, and materialize it once it's hot. Returns if the node is ready.
+func (idx *Index) materializeOnQuery(n *index_node) bool {
+	if !idx.LazyCombinations || len(n.tags) < 2 {
+		return false
+	}
+
+	c := idx.writeConn(idx.tagQueryShard())
+	queries, _ := redis.Int(idx.ast2(c.Do("ZINCRBY", idx.What+const_key_lazy_query_count, 1, n.node)))
+	c.Close()
+	if queries < idx.LazyCombinationQueries {
+		return false
+	}
+
+	// registered like the eager ones before the intersection, so the items indexed meanwhile are attached too,
+	// and later the items are detached precisely & the node is kept up to date.
+	for _, tag := range n.tags {
+		c := idx.writeConn(idx.str2shard(escapeTag(tag)))
+		idx.ast2(c.Do("SADD", idx.tagCombinationKey(tag), n.node))
+		c.Close()
+	}
+
+	ids := idx.materialize(n)
+	if len(ids) == 0 {
+		n.unregisterCombination()
+		return false
+	}
+
+	for _, id := range ids {
+		c := idx.writeConn(idx.id2shard(id))
+		idx.ast2(c.Do("SADD", idx.itemCombinationKey(id), n.node))
+		c.Close()
+	}
+
+	c = idx.writeConn(idx.tagQueryShard())
+	idx.ast2(c.Do("ZREM", idx.What+const_key_lazy_query_count, n.node))
+	c.Close()
+
+	idx.logger().Println("A combination materialized:", idx.What, n.tags, "items:", len(ids))
+	return true
+}
+
+// is the missing combination being materialized: its queries are counted until it's done.
+func (idx *Index) materializing(n *index_node) bool {
+	c := idx.primaryConn(idx.tagQueryShard())
+	defer c.Close()
+	queries, err := redis.Int(idx.ast2(c.Do("ZSCORE", idx.What+const_key_lazy_query_count, n.node)))
+	return err == nil && queries >= idx.LazyCombinationQueries
+}
+
+// build the combination node from the basic nodes of its tags, returns the items in.
+// The score & date ranks are the same in every basic node, the overall rank takes the lowest one.
+func (idx *Index) materialize(n *index_node) []uint64 {
+	basics := make([]*index_node, len(n.tags))
+	for i, tag := range n.tags {
+		basics[i] = newIndexNode(idx, []string{tag}, 1.0)
+	}
+
+	if idx.shardCount() == 1 && !idx.cluster() {
+		// all the keys are together: intersect on the server side.
+		return n.materializeOnServer(basics, idx.lazyTTL())
+	}
+
+	var smallest *index_node
+	smallest_count := 0
+	for _, basic := range basics {
+		if count := basic.itemCount(); smallest == nil || count < smallest_count {
+			smallest, smallest_count = basic, count
+		}
+	}
+	ids := smallest.items()
+	for _, basic := range basics {
+		if basic != smallest && len(ids) != 0 {
+			ids = basic.itemFilter(ids)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	scores := smallest.rankScores(const_key_idx_score_rank, ids)
+	dates := smallest.rankScores(const_key_idx_date_rank, ids)
+	overalls := smallest.rankScores(const_key_idx_overall_rank, ids)
+	for _, basic := range basics {
+		if basic == smallest {
+			continue
+		}
+		for i, overall := range basic.rankScores(const_key_idx_overall_rank, ids) {
+			if overall < overalls[i] {
+				overalls[i] = overall
+			}
+		}
+	}
+
+	c := idx.writeConn(n.shard)
+	defer c.Close()
+	for i, id := range ids {
+		c.Send("SADD", n.idstr(const_key_idx_base_set), id)
+		c.Send("ZADD", n.idstr(const_key_idx_score_rank), scores[i], id)
+		c.Send("ZADD", n.idstr(const_key_idx_date_rank), dates[i], id)
+		c.Send("ZADD", n.idstr(const_key_idx_overall_rank), overalls[i], id)
+	}
+	n.sendExpire(c, idx.lazyTTL())
+	c.Flush()
+	for i := 0; i < len(ids)*4+4; i++ {
+		idx.ast2(c.Receive())
+	}
+	return ids
+}
+
+func (n *index_node) materializeOnServer(basics []*index_node, ttl int) []uint64 {
+	c := n.idx.writeConn(n.shard)
+	defer c.Close()
+
+	keysOf := func(key string) []interface{} {
+		args := []interface{}{n.idstr(key), len(basics)}
+		for _, basic := range basics {
+			args = append(args, basic.idstr(key))
+		}
+		return args
+	}
+	base := keysOf(const_key_idx_base_set)
+	c.Send("SINTERSTORE", append(base[:1:1], base[2:]...)...)
+	c.Send("ZINTERSTORE", append(keysOf(const_key_idx_score_rank), "AGGREGATE", "MAX")...)
+	c.Send("ZINTERSTORE", append(keysOf(const_key_idx_date_rank), "AGGREGATE", "MAX")...)
+	c.Send("ZINTERSTORE", append(keysOf(const_key_idx_overall_rank), "AGGREGATE", "MIN")...)
+	n.sendExpire(c, ttl)
+	c.Flush()
+	for i := 0; i < 8; i++ {
+		n.idx.ast2(c.Receive())
+	}
+	return n.items()
+}
+
+func (n *index_node) sendExpire(c redis.Conn, ttl int) {
+	c.Send("EXPIRE", n.idstr(const_key_idx_base_set), ttl)
+	c.Send("EXPIRE", n.idstr(const_key_idx_score_rank), ttl)
+	c.Send("EXPIRE", n.idstr(const_key_idx_date_rank), ttl)
+	c.Send("EXPIRE", n.idstr(const_key_idx_overall_rank), ttl)
+}
+
+// keep a queried combination alive.
+func (idx *Index) touchLazy(n *index_node) {
+	if !idx.LazyCombinations || len(n.tags) < 2 {
+		return
+	}
+	c := idx.writeConn(n.shard)
+	defer c.Close()
+	n.sendExpire(c, idx.lazyTTL())
+	c.Flush()
+	for i := 0; i < 4; i++ {
+		idx.ast2(c.Receive())
+	}
+}
+
+// the scores of the items in a rank of the node.
+func (n *index_node) rankScores(key string, ids []uint64) []float64 {
+	c := n.idx.primaryConn(n.shard)
+	defer c.Close()
+	for _, id := range ids {
+		c.Send("ZSCORE", n.idstr(key), id)
+	}
+	c.Flush()
+	scores := make([]float64, len(ids))
+	for i := range ids {
+		scores[i], _ = redis.Float64(n.idx.ast2(c.Receive()))
+	}
+	return scores
+}
+
+// attach the item to the materialized combinations of its tags, instead of building them all.
+func (idx *Index) attachLazyCombinations(item Item, infos []*taginfo) {
+	idx.pruneExpiredCombinations(item.Id())
+
+	scores := make(map[string]float64)
+	for _, info := range infos {
+		scores[info.title] = 1.0
+		for i, alias := range info.aliases {
+			if score := info.alias_scores[i]; score > scores[alias] {
+				scores[alias] = score
+			}
+		}
+	}
+	tags := make([]string, 0, len(scores))
+	for tag := range scores {
+		tags = append(tags, tag)
+	}
+
+	for tag := range scores {
+		for _, combination := range idx.combinationsOfTag(tag) {
+			combination_tags := splitTags(combination)
+			// each combination once: by its first tag.
+			if combination_tags[0] != tag || !containsTags(tags, combination_tags) {
+				continue
+			}
+			n := newIndexNode(idx, combination_tags, 1.0)
+			if !n.exists() && !idx.materializing(n) {
+				// expired.
+				n.unregisterCombination()
+				continue
+			}
+			for _, tag := range combination_tags {
+				n.tags_score *= scores[tag]
+			}
+			n.attach(item)
+			n.registerCombination(item)
+		}
+	}
+}
+
+// the expired combinations are left in the item's registry, drop them before attaching again.
+func (idx *Index) pruneExpiredCombinations(id uint64) {
+	key := idx.itemCombinationKey(id)
+	c := idx.writeConn(idx.id2shard(id))
+	defer c.Close()
+	combinations, _ := redis.Strings(idx.ast2(c.Do("SMEMBERS", key)))
+	for _, combination := range combinations {
+		if combination == const_combination_tracked {
+			continue
+		}
+		if n := newIndexNode(idx, splitTags(combination), 1.0); !n.exists() && !idx.materializing(n) {
+			idx.ast2(c.Do("SREM", key, combination))
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package tagstack
+
+import (
+	"github.com/semicircle/gozhszht"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+)
+
+// A step of tag normalization, it's applied identically at indexing & searching time.
+// A normalizer returning "" drops the tag.
+type Normalizer func(tag string) string
+
+// Built-in normalizers.
+var (
+	// Unicode NFKC, this covers the full width forms too.
+	NormalizeNFKC Normalizer = norm.NFKC.String
+
+	// Lower case.
+	NormalizeCase Normalizer = strings.ToLower
+
+	// Remove the spaces around.
+	NormalizeTrim Normalizer = strings.TrimSpace
+
+	// Full width ASCII & the ideographic space to half width.
+	NormalizeWidth Normalizer = func(tag string) string { return strings.Map(foldWidth, tag) }
+
+	// Traditional Chinese to simplified Chinese.
+	NormalizeSimplified Normalizer = gozhszht.ToSimple
+)
+
+// The normalizers used when Index.Normalizers is nil, as tagstack always did.
+var DefaultNormalizers = []Normalizer{NormalizeSimplified}
+
+// Run the normalizers on the tags, the input slice is left untouched.
+// Empty tags are dropped, and duplicated tags are only kept once.
+func (idx *Index) normalizeTags(tags []string) []string {
+	ret := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = idx.normalizeTag(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		ret = append(ret, tag)
+	}
+	return ret
+}
+
+// Like normalizeTags, for the item's tags: a duplicated tag keeps the highest score.
+// nil scores are taken as 1.0 for every tag.
+// The original forms are returned too, a duplicated tag keeps the first one.
+func (idx *Index) normalizeTagsWithScore(tags []string, scores []float64) ([]string, []float64, []string) {
+	ret_tags := make([]string, 0, len(tags))
+	ret_scores := make([]float64, 0, len(tags))
+	ret_originals := make([]string, 0, len(tags))
+	pos := make(map[string]int, len(tags))
+	for i, tag := range tags {
+		score := 1.0
+		if scores != nil {
+			score = scores[i]
+		}
+		original := tag
+		tag = idx.normalizeTag(tag)
+		if tag == "" {
+			continue
+		}
+		if j, ok := pos[tag]; ok {
+			if score > ret_scores[j] {
+				ret_scores[j] = score
+			}
+			continue
+		}
+		pos[tag] = len(ret_tags)
+		ret_tags = append(ret_tags, tag)
+		ret_scores = append(ret_scores, score)
+		ret_originals = append(ret_originals, original)
+	}
+	return ret_tags, ret_scores, ret_originals
+}
+
+func (idx *Index) normalizeTag(tag string) string {
+	normalizers := idx.Normalizers
+	if normalizers == nil {
+		normalizers = DefaultNormalizers
+	}
+	for _, normalizer := range normalizers {
+		if tag == "" {
+			break
+		}
+		tag = normalizer(tag)
+	}
+	return tag
+}
+
+func foldWidth(r rune) rune {
+	switch {
+	case r == '　':
+		return ' '
+	case r >= '！' && r <= '～':
+		return r - 0xfee0
+	}
+	return r
+}
@@ -0,0 +1,30 @@
+package tagstack
+
+import (
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	x := &Index{Normalizers: []Normalizer{NormalizeNFKC, NormalizeTrim, NormalizeCase}}
+
+	input := []string{" ＡＢ ", "ab", "Cd", "  "}
+	tags := x.normalizeTags(input)
+	must(len(tags) == 2 && tags[0] == "ab" && tags[1] == "cd", "normalizeTags:", tags)
+	must(input[0] == " ＡＢ " && input[2] == "Cd", "normalizeTags changed the input:", input)
+
+	tags, scores, originals := x.normalizeTagsWithScore([]string{"AB", "ab", "cd"}, []float64{0.5, 0.9, 0.1})
+	must(len(tags) == 2 && tags[0] == "ab" && scores[0] == 0.9 && scores[1] == 0.1, "normalizeTagsWithScore:", tags, scores)
+	must(originals[0] == "AB" && originals[1] == "cd", "normalizeTagsWithScore:", originals)
+
+	tags, scores, _ = x.normalizeTagsWithScore([]string{"AB"}, nil)
+	must(len(tags) == 1 && scores[0] == 1.0, "normalizeTagsWithScore:", tags, scores)
+
+	// nothing left to search: no redis round trip.
+	must(len(x.Query([]string{"  "}, 0, 10)) == 0, "Query with no tag")
+	must(x.ItemCount([]string{""}) == 0, "ItemCount with no tag")
+	must(len(x.RelativeTags([]string{" "}, 10)) == 0, "RelativeTags with no tag")
+}
+
+func TestNormalizeWidth(t *testing.T) {
+	must(NormalizeWidth("ＡＢ　１") == "AB 1", "NormalizeWidth:", NormalizeWidth("ＡＢ　１"))
+}
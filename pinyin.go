@@ -0,0 +1,71 @@
+package tagstack
+
+import (
+	"github.com/mozillazg/go-pinyin"
+	"github.com/semicircle/gozhszht"
+	"strings"
+	"unicode"
+)
+
+// the embedded pinyin table, non-han characters are kept as they are (lower cased).
+var pinyinArgs = pinyin.Args{
+	Style: pinyin.Normal,
+	Fallback: func(r rune, a pinyin.Args) []string {
+		return []string{string(unicode.ToLower(r))}
+	},
+}
+
+// The romanized forms of a tag: full pinyin & initials, eg: 鼓浪屿 -> "gulangyu", "gly".
+// Returns nil if there's no han character in the tag.
+func romanize(tag string) []string {
+	tag = gozhszht.ToSimple(tag)
+
+	has_han := false
+	for _, r := range tag {
+		if unicode.Is(unicode.Han, r) {
+			has_han = true
+			break
+		}
+	}
+	if !has_han {
+		return nil
+	}
+
+	full := make([]string, 0, len(tag))
+	initials := make([]string, 0, len(tag))
+	for _, py := range pinyin.Pinyin(tag, pinyinArgs) {
+		if len(py) == 0 || strings.TrimSpace(py[0]) == "" {
+			continue
+		}
+		full = append(full, py[0])
+		initials = append(initials, string([]rune(py[0])[:1]))
+	}
+
+	ret := []string{strings.Join(full, "")}
+	if short := strings.Join(initials, ""); short != ret[0] {
+		ret = append(ret, short)
+	}
+	return ret
+}
+
+// Is a user input a romanized (pinyin) prefix ? returns the form to match the pinyin set.
+// Spaces & apostrophes (xi'an) are ignored.
+func pinyinQuery(input string) (string, bool) {
+	romanized := make([]rune, 0, len(input))
+	for _, r := range strings.ToLower(input) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			romanized = append(romanized, r)
+		case r >= '0' && r <= '9':
+			romanized = append(romanized, r)
+		case r == ' ' || r == '\'':
+			continue
+		default:
+			return "", false
+		}
+	}
+	if len(romanized) == 0 {
+		return "", false
+	}
+	return string(romanized), true
+}
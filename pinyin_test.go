@@ -0,0 +1,24 @@
+package tagstack
+
+import (
+	"testing"
+)
+
+func TestRomanize(t *testing.T) {
+	r := romanize("鼓浪屿")
+	must(len(r) == 2 && r[0] == "gulangyu" && r[1] == "gly", "romanize:", r)
+
+	r = romanize("A咖啡")
+	must(len(r) == 2 && r[0] == "akafei" && r[1] == "akf", "romanize:", r)
+
+	r = romanize("abc")
+	must(r == nil, "romanize:", r)
+}
+
+func TestPinyinQuery(t *testing.T) {
+	q, ok := pinyinQuery("Xi'an")
+	must(ok && q == "xian", "pinyinQuery:", q, ok)
+
+	_, ok = pinyinQuery("鼓浪")
+	must(!ok, "pinyinQuery: han input is not pinyin")
+}
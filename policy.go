@@ -0,0 +1,154 @@
+package tagstack
+
+import (
+	"sort"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+)
+
+// What tags are worth indexing, applied to the items' tags after the normalizers & before the rules.
+// The zero value lets everything in.
+type TagPolicy struct {
+	// Tags never to be indexed.
+	Blocklist []string
+	// Tags too common to mean anything, eg: 推荐, 好
+	Stopwords []string
+
+	// Length limits in characters, 0 means no limit.
+	MinLength int
+	MaxLength int
+
+	// At most this many tags per item, the ones with the highest scores are kept. 0 means no limit.
+	MaxTags int
+
+	// Drop the tags made of punctuation & symbols only.
+	DropPunctuation bool
+	// Optional: a tag with any character not allowed is dropped.
+	AllowedChar func(r rune) bool
+}
+
+// How many tags were dropped by the TagPolicy, and why.
+type TagPolicyStats struct {
+	Blocked     uint64
+	Stopwords   uint64
+	TooShort    uint64
+	TooLong     uint64
+	Punctuation uint64
+	BadChars    uint64
+	OverLimit   uint64
+}
+
+type tagPolicy struct {
+	*TagPolicy
+	blocklist map[string]bool
+	stopwords map[string]bool
+	stats     TagPolicyStats
+}
+
+func (idx *Index) initTagPolicy() {
+	p := &tagPolicy{TagPolicy: idx.TagPolicy, blocklist: make(map[string]bool), stopwords: make(map[string]bool)}
+	if p.TagPolicy == nil {
+		p.TagPolicy = &TagPolicy{}
+	}
+	// compare in the normalized forms.
+	for _, tag := range p.Blocklist {
+		p.blocklist[idx.normalizeTag(tag)] = true
+	}
+	for _, tag := range p.Stopwords {
+		p.stopwords[idx.normalizeTag(tag)] = true
+	}
+	idx.policy = p
+}
+
+// The counters of the tags dropped by the TagPolicy since Init.
+func (index *Index) TagPolicyStats() TagPolicyStats {
+	s := &index.policy.stats
+	return TagPolicyStats{
+		Blocked:     atomic.LoadUint64(&s.Blocked),
+		Stopwords:   atomic.LoadUint64(&s.Stopwords),
+		TooShort:    atomic.LoadUint64(&s.TooShort),
+		TooLong:     atomic.LoadUint64(&s.TooLong),
+		Punctuation: atomic.LoadUint64(&s.Punctuation),
+		BadChars:    atomic.LoadUint64(&s.BadChars),
+		OverLimit:   atomic.LoadUint64(&s.OverLimit),
+	}
+}
+
+// filter the item's tags, the parallel slices are filtered together.
+func (p *tagPolicy) apply(tags []string, scores []float64, originals []string) ([]string, []float64, []string) {
+	kept := make([]int, 0, len(tags))
+	for i, tag := range tags {
+		if counter := p.check(tag); counter != nil {
+			atomic.AddUint64(counter, 1)
+			continue
+		}
+		kept = append(kept, i)
+	}
+
+	if p.MaxTags > 0 && len(kept) > p.MaxTags {
+		// the highest scores, the earlier one wins a tie.
+		sort.Stable(&keptSorter{kept: kept, scores: scores})
+		atomic.AddUint64(&p.stats.OverLimit, uint64(len(kept)-p.MaxTags))
+		kept = kept[:p.MaxTags]
+		sort.Ints(kept)
+	}
+
+	if len(kept) == len(tags) {
+		return tags, scores, originals
+	}
+	ret_tags := make([]string, len(kept))
+	ret_scores := make([]float64, len(kept))
+	ret_originals := make([]string, len(kept))
+	for i, k := range kept {
+		ret_tags[i], ret_scores[i], ret_originals[i] = tags[k], scores[k], originals[k]
+	}
+	return ret_tags, ret_scores, ret_originals
+}
+
+// the counter to increase if the tag is dropped, or nil.
+func (p *tagPolicy) check(tag string) *uint64 {
+	if p.blocklist[tag] {
+		return &p.stats.Blocked
+	}
+	if p.stopwords[tag] {
+		return &p.stats.Stopwords
+	}
+	length := utf8.RuneCountInString(tag)
+	if p.MinLength > 0 && length < p.MinLength {
+		return &p.stats.TooShort
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return &p.stats.TooLong
+	}
+	if p.DropPunctuation {
+		meaningful := false
+		for _, r := range tag {
+			if !unicode.IsPunct(r) && !unicode.IsSymbol(r) && !unicode.IsSpace(r) {
+				meaningful = true
+				break
+			}
+		}
+		if !meaningful {
+			return &p.stats.Punctuation
+		}
+	}
+	if p.AllowedChar != nil {
+		for _, r := range tag {
+			if !p.AllowedChar(r) {
+				return &p.stats.BadChars
+			}
+		}
+	}
+	return nil
+}
+
+// sort the kept positions by their scores descending.
+type keptSorter struct {
+	kept   []int
+	scores []float64
+}
+
+func (s *keptSorter) Len() int           { return len(s.kept) }
+func (s *keptSorter) Swap(i, j int)      { s.kept[i], s.kept[j] = s.kept[j], s.kept[i] }
+func (s *keptSorter) Less(i, j int) bool { return s.scores[s.kept[i]] > s.scores[s.kept[j]] }
@@ -0,0 +1,36 @@
+package tagstack
+
+import (
+	"testing"
+)
+
+func TestTagPolicy(t *testing.T) {
+	x := &Index{
+		Normalizers: []Normalizer{NormalizeTrim, NormalizeCase},
+		TagPolicy: &TagPolicy{
+			Blocklist:       []string{"Spam"},
+			Stopwords:       []string{"推荐", "好"},
+			MinLength:       1,
+			MaxLength:       6,
+			MaxTags:         3,
+			DropPunctuation: true,
+			AllowedChar:     func(r rune) bool { return r != '@' },
+		},
+	}
+	x.initTagPolicy()
+
+	tags, scores, originals := x.normalizeTagsWithScore(
+		[]string{"spam", "推荐", "鼓浪屿", "！", "a@b", "toolongtag", "a", "b", "c", "d"},
+		[]float64{1, 1, 0.9, 1, 1, 1, 0.1, 0.5, 0.8, 0.2})
+	tags, scores, originals = x.policy.apply(tags, scores, originals)
+	must(len(tags) == 3 && tags[0] == "鼓浪屿" && tags[1] == "b" && tags[2] == "c", "tags:", tags)
+	must(len(scores) == 3 && scores[2] == 0.8 && originals[0] == "鼓浪屿", "scores & originals:", scores, originals)
+
+	stats := x.TagPolicyStats()
+	must(stats == TagPolicyStats{Blocked: 1, Stopwords: 1, TooLong: 1, Punctuation: 1, BadChars: 1, OverLimit: 2}, "stats:", stats)
+
+	x = &Index{}
+	x.initTagPolicy()
+	tags, _, _ = x.policy.apply([]string{"！", "a"}, []float64{1, 1}, []string{"！", "a"})
+	must(len(tags) == 2, "zero policy:", tags)
+}
@@ -0,0 +1,117 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+)
+
+// The combination registry: which combination nodes (2 tags or more) exist, looked up structurally instead of
+// scanning the high tags set with a glob.
+// 1. per item: the combination nodes the item is attached to, so detaching touches exactly the item's own ones.
+// 2. per tag: the combination nodes with the tag in.
+const (
+	const_key_item_combination_set = "tics."
+	const_key_tag_combination_set  = "ttcs."
+
+	// the member marking an item's combinations are registered, the item is indexed before the registry if it's missing.
+	const_combination_tracked = ""
+)
+
+func (idx *Index) itemCombinationKey(id uint64) string {
+	return idx.What + const_key_item_combination_set + idx.hashTag(strconv.FormatUint(id, 10))
+}
+
+func (idx *Index) tagCombinationKey(tag string) string {
+	return idx.What + const_key_tag_combination_set + idx.hashTag(escapeTag(tag))
+}
+
+func (idx *Index) trackCombinations(id uint64) {
+	c := idx.writeConn(idx.id2shard(id))
+	defer c.Close()
+	idx.ast2(c.Do("SADD", idx.itemCombinationKey(id), const_combination_tracked))
+}
+
+func (idx *Index) untrackCombinations(id uint64) {
+	c := idx.writeConn(idx.id2shard(id))
+	defer c.Close()
+	idx.ast2(c.Do("DEL", idx.itemCombinationKey(id)))
+}
+
+// register the combination node for the item & for each of its tags.
+func (node *index_node) registerCombination(item Item) {
+	item_id := item.Id()
+	c := node.idx.writeConn(node.idx.id2shard(item_id))
+	node.idx.ast2(c.Do("SADD", node.idx.itemCombinationKey(item_id), node.node))
+	c.Close()
+
+	for _, tag := range node.tags {
+		c := node.idx.writeConn(node.idx.str2shard(escapeTag(tag)))
+		node.idx.ast2(c.Do("SADD", node.idx.tagCombinationKey(tag), node.node))
+		c.Close()
+	}
+}
+
+// the reverse of registerCombination for the tags, when the node is emptied or dropped.
+func (node *index_node) unregisterCombination() {
+	for _, tag := range node.tags {
+		c := node.idx.writeConn(node.idx.str2shard(escapeTag(tag)))
+		node.idx.ast2(c.Do("SREM", node.idx.tagCombinationKey(tag), node.node))
+		c.Close()
+	}
+}
+
+// The combination nodes with the tag in.
+func (idx *Index) combinationsOfTag(tag string) []string {
+	c := idx.primaryConn(idx.str2shard(escapeTag(tag)))
+	defer c.Close()
+	nodes, _ := redis.Strings(idx.ast2(c.Do("SMEMBERS", idx.tagCombinationKey(tag))))
+	return nodes
+}
+
+// detach the item from the combination nodes having all of node.tags.
+func (node *index_node) detach_deeper(item Item) {
+	item_id := item.Id()
+	key := node.idx.itemCombinationKey(item_id)
+
+	c := node.idx.writeConn(node.idx.id2shard(item_id))
+	defer c.Close()
+	combinations, _ := redis.Strings(node.idx.ast2(c.Do("SMEMBERS", key)))
+	if len(combinations) == 0 {
+		// indexed before the registry.
+		node.detach_deeper_scan(item)
+		return
+	}
+
+	for _, combination := range combinations {
+		if combination == const_combination_tracked {
+			continue
+		}
+		tags := splitTags(combination)
+		if !containsTags(tags, node.tags) {
+			continue
+		}
+		n := newIndexNode(node.idx, tags, 1.0)
+		n.detach(item)
+		node.idx.ast2(c.Do("SREM", key, combination))
+		if n.itemCount() == 0 {
+			n.unregisterCombination()
+		}
+	}
+}
+
+// does tags have all of the subset ?
+func containsTags(tags, subset []string) bool {
+	for _, s := range subset {
+		found := false
+		for _, tag := range tags {
+			if tag == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
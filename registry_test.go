@@ -0,0 +1,11 @@
+package tagstack
+
+import (
+	"testing"
+)
+
+func TestContainsTags(t *testing.T) {
+	must(containsTags([]string{"A", "B", "C"}, []string{"A", "C"}), "containsTags")
+	must(!containsTags([]string{"AB", "C"}, []string{"A"}), "containsTags: A is not in AB|C")
+	must(containsTags(splitTags(joinTags([]string{"a|b", "c"}, const_tags_separator)), []string{"a|b"}), "containsTags: escaped")
+}
@@ -0,0 +1,114 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// the connection to read through the replicas of the shard.
+// Query / ItemCount / RelativeTags go round robin over ReadReplicas, and to the primary if there's none,
+// or the index has written in ReplicaStaleness.
+func (idx *Index) readConn(shard int) redis.Conn {
+	if len(idx.ReadReplicas) == 0 || idx.writtenWithin(idx.ReplicaStaleness) {
+		return idx.primaryConn(shard)
+	}
+	next := atomic.AddUint32(&idx.replicaNext, 1)
+	c := idx.ReadReplicas[int(next%uint32(len(idx.ReadReplicas)))](shard)
+	if c == nil || c.Err() != nil {
+		if c != nil {
+			c.Close()
+		}
+		return idx.primaryConn(shard)
+	}
+	return &failoverConn{Conn: c, idx: idx, shard: shard}
+}
+
+// a node reading through the replicas.
+func (idx *Index) readNode(tags []string) *index_node {
+	n := newIndexNode(idx, tags, 1.0)
+	n.read = idx.readConn
+	return n
+}
+
+func (idx *Index) markWritten() {
+	atomic.StoreInt64(&idx.lastWrite, time.Now().UnixNano())
+}
+
+func (idx *Index) writtenWithin(d time.Duration) bool {
+	return d > 0 && time.Now().UnixNano()-atomic.LoadInt64(&idx.lastWrite) < int64(d)
+}
+
+// A replica connection falling back to the primary once it fails, the commands sent & not received yet are resent.
+type failoverConn struct {
+	redis.Conn
+	idx     *Index
+	shard   int
+	primary bool
+	pending [][]interface{}
+}
+
+func (c *failoverConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	if c.failover(err) {
+		reply, err = c.Conn.Do(cmd, args...)
+	}
+	c.pending = nil
+	return reply, err
+}
+
+func (c *failoverConn) Send(cmd string, args ...interface{}) error {
+	c.pending = append(c.pending, append([]interface{}{cmd}, args...))
+	err := c.Conn.Send(cmd, args...)
+	if c.failover(err) {
+		// resent.
+		return nil
+	}
+	return err
+}
+
+func (c *failoverConn) Flush() error {
+	err := c.Conn.Flush()
+	if c.failover(err) {
+		err = c.Conn.Flush()
+	}
+	return err
+}
+
+func (c *failoverConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	if c.failover(err) {
+		if err = c.Conn.Flush(); err == nil {
+			reply, err = c.Conn.Receive()
+		}
+	}
+	if len(c.pending) != 0 {
+		c.pending = c.pending[1:]
+	}
+	return reply, err
+}
+
+// switch to the primary if the replica fails, and resend the pending commands.
+func (c *failoverConn) failover(err error) bool {
+	if err == nil || c.primary || !replicaFailed(err) {
+		return false
+	}
+	c.idx.logger().Println("Reading from the primary, the replica fails:", c.shard, err)
+	c.Conn.Close()
+	c.Conn = c.idx.primaryConn(c.shard)
+	c.primary = true
+	for _, p := range c.pending {
+		c.Conn.Send(p[0].(string), p[1:]...)
+	}
+	return true
+}
+
+// the connection errors, and the replies of a replica not ready to serve.
+func replicaFailed(err error) bool {
+	if e, ok := err.(redis.Error); ok {
+		msg := string(e)
+		return strings.HasPrefix(msg, "LOADING") || strings.HasPrefix(msg, "MASTERDOWN") || strings.HasPrefix(msg, "READONLY")
+	}
+	return true
+}
@@ -0,0 +1,22 @@
+package tagstack
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"testing"
+	"time"
+)
+
+func TestReplicaFailed(t *testing.T) {
+	must(replicaFailed(errors.New("connection refused")), "connection error")
+	must(replicaFailed(redis.Error("LOADING Redis is loading the dataset in memory")), "loading")
+	must(!replicaFailed(redis.Error("WRONGTYPE Operation against a key holding the wrong kind of value")), "reply error")
+}
+
+func TestReplicaStaleness(t *testing.T) {
+	index := &Index{}
+	must(!index.writtenWithin(time.Second), "never written")
+	index.markWritten()
+	must(index.writtenWithin(time.Second), "just written")
+	must(!index.writtenWithin(0), "no staleness")
+}
@@ -0,0 +1,221 @@
+package tagstack
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"hash/adler32"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the points of each shard on the ring.
+const const_router_replicas = 160
+
+// Consistent hashing of the keys onto the shards 0 .. n-1, set it to Index.Router (or the global Router).
+// GetReadConn / GetWriteConn get a shard index instead of a raw checksum then,
+// and adding a shard moves only about 1/n of the keys, see RebalanceShards.
+type ShardRouter struct {
+	shards int
+	points []uint32
+	owners []int
+}
+
+func NewShardRouter(shards int) (*ShardRouter, error) {
+	if shards < 1 {
+		return nil, fmt.Errorf("NewShardRouter: shards < 1")
+	}
+	r := &ShardRouter{shards: shards}
+	for shard := 0; shard < shards; shard++ {
+		for i := 0; i < const_router_replicas; i++ {
+			r.points = append(r.points, hash32(strconv.Itoa(shard)+"#"+strconv.Itoa(i)))
+			r.owners = append(r.owners, shard)
+		}
+	}
+	sort.Sort((*ringSorter)(r))
+	return r, nil
+}
+
+// sort the points of the ring, with their owners.
+type ringSorter ShardRouter
+
+func (r *ringSorter) Len() int { return len(r.points) }
+func (r *ringSorter) Swap(i, j int) {
+	r.points[i], r.points[j] = r.points[j], r.points[i]
+	r.owners[i], r.owners[j] = r.owners[j], r.owners[i]
+}
+func (r *ringSorter) Less(i, j int) bool { return r.points[i] < r.points[j] }
+
+// How many shards.
+func (r *ShardRouter) Shards() int {
+	return r.shards
+}
+
+// The shard of a routing key.
+func (r *ShardRouter) Shard(key string) int {
+	h := hash32(key)
+	i := sort.Search(len(r.points), func(j int) bool { return r.points[j] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// the shard of the keys routed by str: the node keys by the node, the tag registry by the tag,
+// and the index-wide keys by the key name.
+func (idx *Index) str2shard(str string) int {
+	if r := idx.router(); r != nil {
+		return r.Shard(str)
+	}
+	return int(adler32.Checksum([]byte(str)))
+}
+
+// the shard of the item keys.
+func (idx *Index) id2shard(id uint64) int {
+	if r := idx.router(); r != nil {
+		return r.Shard(strconv.FormatUint(id, 10))
+	}
+	return int(id)
+}
+
+// the high tags set of an index is one key with Router, or a set on each node's shard without.
+func (idx *Index) highTagsShard(node_shard int) int {
+	if r := idx.router(); r != nil {
+		return r.Shard(const_key_high_tags_set + idx.What)
+	}
+	return node_shard
+}
+
+// how many shards to go through for the scans of the index-wide keys.
+func (idx *Index) shardCount() int {
+	if idx.cluster() {
+		// the cluster aware connection finds the key.
+		return 1
+	}
+	if r := idx.router(); r != nil {
+		return r.Shards()
+	}
+	return idx.shardMax()
+}
+
+// the routing key of a key of the index, false if it's not a key of the index.
+// The item tag hashes are shared by the indexes of the same items, RebalanceShards checks the item is in this one.
+func (idx *Index) routingKey(key string) (string, bool) {
+	switch {
+	case key == const_key_high_tags_set+idx.What:
+		return key, true
+	case strings.HasPrefix(key, const_key_item_tag_hash):
+		return strings.TrimPrefix(key, const_key_item_tag_hash), true
+	case !strings.HasPrefix(key, idx.What) || len(key) < len(idx.What)+len(const_key_idx_base_set):
+		return "", false
+	}
+
+	rest := key[len(idx.What):]
+	prefix, name := rest[:len(const_key_idx_base_set)], rest[len(const_key_idx_base_set):]
+	switch prefix {
+	case const_key_idx_base_set, const_key_idx_score_rank, const_key_idx_date_rank, const_key_idx_overall_rank,
+		const_key_idx_relative_rank, const_key_idx_rand_sug_set, const_key_tag_display_rank:
+		// the node.
+		return name, true
+	case const_key_item_combination_set, const_key_item_display_hash, const_key_tag_combination_set:
+		// the item id, or the escaped tag.
+		return name, true
+	case const_key_tag_dict_lex, const_key_tag_dict_count, const_key_tag_dict_pinyin, const_key_tag_dict_popular:
+		return idx.What + const_key_tag_dict_lex, true
+	case const_key_tag_query_count, const_key_lazy_query_count:
+		return idx.What + const_key_tag_query_count, true
+	}
+	return "", false
+}
+
+// Move the keys of the index placed by the router from onto the shards of the router to, eg: after a shard is added,
+// the shard indexes of from should stay the same in to. Indexing should be paused meanwhile, and Router set to to after.
+// Returns how many keys are moved.
+func (index *Index) RebalanceShards(from, to *ShardRouter) (moved int) {
+	if index.cluster() {
+		index.logger().Panicln("RebalanceShards: Redis Cluster rebalances the slots itself.")
+	}
+
+	// the keys are all found before any is moved, the item tag hashes are told apart by the nodes in place.
+	keys := make([][]string, from.Shards())
+	for shard := range keys {
+		c := index.writeConn(shard)
+		for _, pattern := range []string{index.What + "*", const_key_item_tag_hash + "*", const_key_high_tags_set + index.What} {
+			scanKeys(c, "SCAN", "", pattern, func(key string) {
+				if routing, ok := index.routingKey(key); ok && from.Shard(routing) == shard {
+					keys[shard] = append(keys[shard], key)
+				}
+			})
+		}
+		owned := keys[shard][:0]
+		for _, key := range keys[shard] {
+			if strings.HasPrefix(key, const_key_item_tag_hash) {
+				if id, err := parseItemKey(const_key_item_tag_hash, key); err != nil || !index.ownsItem(c, from, id) {
+					continue
+				}
+			}
+			owned = append(owned, key)
+		}
+		keys[shard] = owned
+		c.Close()
+	}
+
+	for shard := range keys {
+		c := index.writeConn(shard)
+		for _, key := range keys[shard] {
+			routing, _ := index.routingKey(key)
+			if target := to.Shard(routing); target != shard {
+				index.moveKey(c, key, target)
+				moved++
+			}
+		}
+		c.Close()
+	}
+	index.logger().Println("RebalanceShards:", index.What, "moved:", moved)
+	return
+}
+
+// The item tag hashes aren't per index: is the item in this index ? Registered in its combination registry,
+// or indexed before the registry & in the basic node of one of its tags. c is the connection of the item's shard.
+func (idx *Index) ownsItem(c redis.Conn, from *ShardRouter, id uint64) bool {
+	if exists, _ := redis.Bool(idx.ast2(c.Do("EXISTS", idx.itemCombinationKey(id)))); exists {
+		return true
+	}
+	titles, _ := redis.Strings(idx.ast2(c.Do("HKEYS", idx.itemKey(const_key_item_tag_hash, id))))
+	for _, title := range titles {
+		n := newIndexNode(idx, []string{title}, 1.0)
+		cn := idx.primaryConn(from.Shard(n.node))
+		in, _ := redis.Bool(idx.ast2(cn.Do("SISMEMBER", n.idstr(const_key_idx_base_set), id)))
+		cn.Close()
+		if in {
+			return true
+		}
+	}
+	return false
+}
+
+// move a key to the target shard, with its ttl.
+func (idx *Index) moveKey(c redis.Conn, key string, target int) {
+	data, err := redis.Bytes(c.Do("DUMP", key))
+	if err == redis.ErrNil {
+		// expired meanwhile.
+		return
+	}
+	idx.ast(err)
+	ttl, _ := redis.Int64(idx.ast2(c.Do("PTTL", key)))
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	t := idx.writeConn(target)
+	idx.ast2(t.Do("RESTORE", key, ttl, data, "REPLACE"))
+	t.Close()
+	idx.ast2(c.Do("DEL", key))
+}
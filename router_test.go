@@ -0,0 +1,54 @@
+package tagstack
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestShardRouter(t *testing.T) {
+	_, err := NewShardRouter(0)
+	must(err != nil, "no shard")
+
+	r, err := NewShardRouter(4)
+	must(err == nil && r.Shard("A|B") == r.Shard("A|B"), "stable")
+
+	counts := make([]int, 4)
+	for i := 0; i < 10000; i++ {
+		counts[r.Shard(strconv.Itoa(i))]++
+	}
+	for shard, count := range counts {
+		must(count > 1500 && count < 3500, "balance:", shard, count)
+	}
+
+	// adding a shard moves the keys onto the new one only.
+	r5, _ := NewShardRouter(5)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := strconv.Itoa(i)
+		if from, to := r.Shard(key), r5.Shard(key); from != to {
+			must(to == 4, "moved between the old shards:", key, from, to)
+			moved++
+		}
+	}
+	must(moved > 1000 && moved < 3000, "moved:", moved)
+}
+
+func TestRoutingKey(t *testing.T) {
+	index := &Index{What: "blog."}
+	node := newIndexNode(index, []string{"A", "B"}, 1.0)
+	key, ok := index.routingKey(node.idstr(const_key_idx_overall_rank))
+	must(ok && key == node.node, "node key:", key)
+	key, ok = index.routingKey(const_key_item_tag_hash + "42")
+	must(ok && key == "42", "item key:", key)
+	key, ok = index.routingKey(index.itemCombinationKey(42))
+	must(ok && key == "42", "item combination key:", key)
+	key, ok = index.routingKey(index.itemDisplayKey(42))
+	must(ok && key == "42", "item display key:", key)
+	key, ok = index.routingKey(index.popularKey("}好"))
+	must(ok && key == index.What+const_key_tag_dict_lex, "popular key:", key)
+	must(index.popularKey("") == "" && index.popularKey("gu") == index.popularKey("g"), "popular key of the first rune")
+	key, ok = index.routingKey(index.What + const_key_tag_dict_pinyin)
+	must(ok && key == index.What+const_key_tag_dict_lex, "dict key:", key)
+	_, ok = index.routingKey("news." + const_key_idx_base_set + "A")
+	must(!ok, "another index")
+}
@@ -1,24 +1,77 @@
 package tagstack
 
 import (
+	"fmt"
+	"regexp"
 	"sort"
+	"strings"
 )
 
 // The rule struct: This should be configured very carefully.
-// It's normal to use a json.Decode to generate this.
+// It's normal to use a json.Decode to generate this, or see LoadRuleFiles for json / yaml files.
 type Rule struct {
-	Normalization map[string][]string
-	Entanglement  [][]string
-	Containing    map[string][]string
+	Normalization map[string][]string `yaml:"Normalization"`
+	Entanglement  [][]string          `yaml:"Entanglement"`
+	Containing    map[string][]string `yaml:"Containing"`
+
+	// Optional: pattern normalizations, tried in order when a tag has no exact Normalization.
+	NormalizationPatterns []NormalizationPattern `yaml:"NormalizationPatterns"`
+
+	// Optional: the weights of the aliases, multiplied into the overall ranking of the alias nodes.
+	// 0 means the default: 0.8 for containing, 0.6 for entanglement.
+	ContainingWeight   float64 `yaml:"ContainingWeight"`
+	EntanglementWeight float64 `yaml:"EntanglementWeight"`
+	// Optional: per containing edge, upper -> lower -> weight.
+	ContainingWeights map[string]map[string]float64 `yaml:"ContainingWeights"`
+	// Optional: per entanglement group, in the same order as Entanglement.
+	EntanglementWeights []float64 `yaml:"EntanglementWeights"`
+	// Optional: multiplied once more for each level above the direct container, 0 means no decay.
+	ContainingDecay float64 `yaml:"ContainingDecay"`
 }
 
+// A pattern normalization, one of Regexp / Prefix / Suffix should be set:
+// Regexp: the tag is rewritten by regexp.ReplaceAllString with Replace.
+// Prefix / Suffix: the prefix / suffix is replaced by Replace, eg: Suffix "市" for "北京市" -> "北京".
+// The result goes through the exact Normalization once more.
+type NormalizationPattern struct {
+	Regexp  string `yaml:"Regexp"`
+	Prefix  string `yaml:"Prefix"`
+	Suffix  string `yaml:"Suffix"`
+	Replace string `yaml:"Replace"`
+}
+
+// default weights of the aliases.
+const (
+	const_containing_weight   = 0.8
+	const_entanglement_weight = 0.6
+)
+
 type rule struct {
 	// from unnormal to normal map.
 	norm_map map[string]string
+	// the compiled NormalizationPatterns.
+	norm_patterns []*normPattern
 	// 'one for all' map.
 	entg_map map[string][]string
+	// the weight of each tag's entanglement group.
+	entg_weights map[string]float64
 	// the 'up chan' map.
 	contain_map map[string][]string
+	// lowest -> upper -> weight, for every upper in contain_map.
+	contain_weights map[string]map[string]float64
+	// the 'down chan' map, reversed contain_map.
+	contained_map map[string][]string
+
+	// optional, records every step of applying the rules, see Explain.
+	trace ruleTracer
+}
+
+type ruleTracer func(stage, tag, detail string)
+
+func (t ruleTracer) log(stage, tag, format string, args ...interface{}) {
+	if t != nil {
+		t(stage, tag, fmt.Sprintf(format, args...))
+	}
 }
 
 func (r *Rule) init() *rule {
@@ -31,12 +84,22 @@ func (r *Rule) init() *rule {
 			ret.norm_map[unnormal_form] = normal_form
 		}
 	}
+	for _, pattern := range r.NormalizationPatterns {
+		p, err := pattern.compile()
+		if err != nil {
+			// reported by Validate.
+			continue
+		}
+		ret.norm_patterns = append(ret.norm_patterns, p)
+	}
 
 	// reverse the map.
 	ret.entg_map = make(map[string][]string)
-	for _, group := range r.Entanglement {
+	ret.entg_weights = make(map[string]float64)
+	for i, group := range r.Entanglement {
 		for _, tag := range group {
 			ret.entg_map[tag] = group
+			ret.entg_weights[tag] = r.entanglementWeight(i)
 		}
 	}
 
@@ -51,45 +114,136 @@ func (r *Rule) init() *rule {
 			}
 		}
 	}
-	DebugLogger.Printf("basic_contain_map: %+v", basic_contain_map)
 	ret.contain_map = make(map[string][]string)
-	for lowest, upperset := range basic_contain_map {
-		plain := make([]string, len(upperset))
-		copy(plain, upperset)
-		DebugLogger.Printf("lowest: %v, plain: %+v, upperset: %+v", lowest, plain, upperset)
-		for i := 0; i < len(plain); i++ {
-			curr := plain[i]
-			// Is this element duplicated with a previous?
-			duplicated_i := false
-			for j := 0; j < i; j++ {
-				if curr == plain[j] {
-					duplicated_i = true
-					break
+	ret.contain_weights = make(map[string]map[string]float64)
+	for lowest := range basic_contain_map {
+		// expand level by level, an upper reached on more than one path keeps the highest weight.
+		plain := make([]string, 0, len(basic_contain_map[lowest]))
+		weights := make(map[string]float64)
+		decay := 1.0
+		level := []string{lowest}
+		for len(level) != 0 {
+			next := make([]string, 0, len(level))
+			for _, lower := range level {
+				for _, upper := range basic_contain_map[lower] {
+					if upper == lowest {
+						continue
+					}
+					weight := r.containingWeight(upper, lower) * decay
+					if last, ok := weights[upper]; !ok {
+						plain = append(plain, upper)
+						next = append(next, upper)
+						weights[upper] = weight
+					} else if weight > last {
+						weights[upper] = weight
+					}
 				}
 			}
-			if duplicated_i {
-				// remove this element
-				plain = append(plain[:i], plain[i+1:]...)
-				i--
-				continue
-			}
-
-			// expand this:
-			if forks, ok := basic_contain_map[curr]; ok {
-				plain = append(plain, forks...)
-			}
+			level = next
+			decay *= r.containingDecay()
 		}
 		ret.contain_map[lowest] = plain
+		ret.contain_weights[lowest] = weights
+	}
+
+	// reverse the map.
+	ret.contained_map = make(map[string][]string)
+	for lowest, uppers := range ret.contain_map {
+		for _, upper := range uppers {
+			ret.contained_map[upper] = append(ret.contained_map[upper], lowest)
+		}
 	}
 
 	return ret
 }
 
+type normPattern struct {
+	re      *regexp.Regexp
+	prefix  string
+	suffix  string
+	replace string
+}
+
+func (p NormalizationPattern) compile() (*normPattern, error) {
+	set := 0
+	for _, x := range []string{p.Regexp, p.Prefix, p.Suffix} {
+		if x != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("pattern %+v: one of Regexp / Prefix / Suffix should be set", p)
+	}
+
+	ret := &normPattern{prefix: p.Prefix, suffix: p.Suffix, replace: p.Replace}
+	if p.Regexp != "" && p.Replace == "" && strings.HasPrefix(p.Regexp, "^") &&
+		strings.HasSuffix(p.Regexp, "$") && !strings.HasSuffix(p.Regexp, "\\$") {
+		return nil, fmt.Errorf("pattern %+v: the whole tag is replaced by nothing", p)
+	}
+	if p.Regexp != "" {
+		re, err := regexp.Compile(p.Regexp)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %+v: %v", p, err)
+		}
+		ret.re = re
+	}
+	return ret, nil
+}
+
+func (p *normPattern) apply(tag string) (string, bool) {
+	switch {
+	case p.re != nil:
+		// a tag replaced by nothing is left as it is, like the prefix & the suffix can't be the whole tag.
+		if p.re.MatchString(tag) {
+			if replaced := p.re.ReplaceAllString(tag, p.replace); replaced != "" {
+				return replaced, true
+			}
+		}
+	case p.prefix != "":
+		if strings.HasPrefix(tag, p.prefix) && len(tag) > len(p.prefix) {
+			return p.replace + tag[len(p.prefix):], true
+		}
+	case p.suffix != "":
+		if strings.HasSuffix(tag, p.suffix) && len(tag) > len(p.suffix) {
+			return tag[:len(tag)-len(p.suffix)] + p.replace, true
+		}
+	}
+	return tag, false
+}
+
+func (r *Rule) containingWeight(upper, lower string) float64 {
+	if w := r.ContainingWeights[upper][lower]; w > 0 {
+		return w
+	}
+	if r.ContainingWeight > 0 {
+		return r.ContainingWeight
+	}
+	return const_containing_weight
+}
+
+func (r *Rule) entanglementWeight(group int) float64 {
+	if group < len(r.EntanglementWeights) && r.EntanglementWeights[group] > 0 {
+		return r.EntanglementWeights[group]
+	}
+	if r.EntanglementWeight > 0 {
+		return r.EntanglementWeight
+	}
+	return const_entanglement_weight
+}
+
+func (r *Rule) containingDecay() float64 {
+	if r.ContainingDecay > 0 {
+		return r.ContainingDecay
+	}
+	return 1.0
+}
+
 // tag info for indexing.
 type taginfo struct {
 	title      string
 	score      float64
-	enrelative bool // enable RelativeTags feature.
+	enrelative bool   // enable RelativeTags feature.
+	display    string // the original form the title came from, "" if there's none.
 
 	// the apply part:
 	disabled     bool // to mark this field is disabled, won't affect the index.
@@ -100,22 +254,7 @@ type taginfo struct {
 // apply the indexing rules on the tags: add aliases / remove duplicated tags and aliases.
 func (r *rule) applyRulesForIndexing(infos []*taginfo) []*taginfo {
 	// normalization.
-	for _, info := range infos {
-		// has a norm_form ?
-		if norm_form, ok := r.norm_map[info.title]; ok {
-			// if the info's normal form is duplicated with another taginfo.title, mark the info as disabled.
-			for _, info2 := range infos {
-				if info != info2 && norm_form == info2.title {
-					info.disabled = true
-					break
-				}
-			}
-			// if the info is not disabled, change it to the normal form.
-			if !info.disabled {
-				info.title = norm_form
-			}
-		}
-	}
+	r.normalizeInfos(infos)
 
 	// containing.
 	// TODO: efficiency: sorting both info & uppers before matching.
@@ -125,8 +264,8 @@ func (r *rule) applyRulesForIndexing(infos []*taginfo) []*taginfo {
 				// set alias.
 				info.aliases = make([]string, len(uppers))
 				copy(info.aliases, uppers)
-				for i := 0; i < len(info.aliases); i++ {
-					info.alias_scores = append(info.alias_scores, 0.8)
+				for _, upper := range uppers {
+					info.alias_scores = append(info.alias_scores, r.contain_weights[info.title][upper])
 				}
 				// if upper is one of the info.titles ? mark the info as disabled.
 				for i, upper := range uppers {
@@ -134,9 +273,11 @@ func (r *rule) applyRulesForIndexing(infos []*taginfo) []*taginfo {
 						if info != info2 && upper == info2.title {
 							info2.disabled = true
 							info.alias_scores[i] = 1.0
+							r.trace.log("containing", info2.title, "disabled: %q is contained by it", info.title)
 							break
 						}
 					}
+					r.trace.log("containing", info.title, "alias %q, score %v", upper, info.alias_scores[i])
 				}
 			}
 		}
@@ -148,9 +289,9 @@ func (r *rule) applyRulesForIndexing(infos []*taginfo) []*taginfo {
 			if aliases, ok := r.entg_map[info.title]; ok {
 				// add the aliases to the unit.
 				info.aliases = append(info.aliases, aliases...)
-				alias_scores := make([]float64, len(info.aliases))
+				alias_scores := make([]float64, len(aliases))
 				for i := 0; i < len(alias_scores); i++ {
-					alias_scores[i] = 0.6
+					alias_scores[i] = r.entg_weights[info.title]
 				}
 
 				// if alias is one of the info. title ? mark the info as disabled & fix the score.
@@ -159,8 +300,10 @@ func (r *rule) applyRulesForIndexing(infos []*taginfo) []*taginfo {
 						if info != info2 && alias == info2.title {
 							info2.disabled = true
 							alias_scores[i] = 1.0
+							r.trace.log("entanglement", info2.title, "disabled: entangled with %q", info.title)
 						}
 					}
+					r.trace.log("entanglement", info.title, "alias %q, score %v", alias, alias_scores[i])
 				}
 
 				info.alias_scores = append(info.alias_scores, alias_scores...)
@@ -169,20 +312,92 @@ func (r *rule) applyRulesForIndexing(infos []*taginfo) []*taginfo {
 	}
 
 	// remove disabled ones.
+	return removeDisabled(infos)
+}
+
+// only the normalization part of the indexing rules, for RULE_EXPANSION_SEARCHING.
+func (r *rule) applyNormalizationForIndexing(infos []*taginfo) []*taginfo {
+	r.normalizeInfos(infos)
+	return removeDisabled(infos)
+}
+
+func (r *rule) normalizeInfos(infos []*taginfo) {
+	for _, info := range infos {
+		// has a norm_form ?
+		if norm_form, ok := r.normalForm(info.title); ok {
+			// if the info's normal form is duplicated with another taginfo.title, mark the info as disabled.
+			for _, info2 := range infos {
+				if info != info2 && norm_form == info2.title {
+					info.disabled = true
+					r.trace.log("normalization", info.title, "disabled: its normal form %q is there", norm_form)
+					break
+				}
+			}
+			// if the info is not disabled, change it to the normal form.
+			// the display keeps the original form, the rule reloading finds the tags normalized away by it.
+			if !info.disabled {
+				r.trace.log("normalization", info.title, "normalized to %q", norm_form)
+				info.title = norm_form
+			}
+		}
+	}
+}
+
+func removeDisabled(infos []*taginfo) []*taginfo {
 	ret := make([]*taginfo, 0, len(infos))
 	for _, info := range infos {
 		if !info.disabled {
 			ret = append(ret, info)
 		}
 	}
+	return ret
+}
+
+// the normal form of a single tag: the exact normalization first, then the patterns.
+func (r *rule) normalForm(tag string) (string, bool) {
+	if norm_form, ok := r.norm_map[tag]; ok {
+		return norm_form, true
+	}
+	for _, p := range r.norm_patterns {
+		if norm_form, ok := p.apply(tag); ok {
+			if exact, ok := r.norm_map[norm_form]; ok {
+				norm_form = exact
+			}
+			return norm_form, norm_form != tag
+		}
+	}
+	return tag, false
+}
 
+// the normal form of a single tag, works on a nil rule too.
+func (r *rule) normalize(tag string) string {
+	if r != nil {
+		tag, _ = r.normalForm(tag)
+	}
+	return tag
+}
+
+// The basic nodes a query tag stands for under RULE_EXPANSION_SEARCHING, and their weights:
+// the tag itself, the tags it contains, and the tags entangled with it.
+func (r *rule) expandForSearching(tag string) map[string]float64 {
+	ret := map[string]float64{tag: 1.0}
+	for _, lower := range r.contained_map[tag] {
+		if w := r.contain_weights[lower][tag]; w > ret[lower] {
+			ret[lower] = w
+		}
+	}
+	for _, alias := range r.entg_map[tag] {
+		if w := r.entg_weights[alias]; w > ret[alias] {
+			ret[alias] = w
+		}
+	}
 	return ret
 }
 
 func (r *rule) applyRulesForSearching(tags []string) []string {
 	tagMap := make(map[string]bool)
 	for _, tag := range tags {
-		if norm_form, ok := r.norm_map[tag]; ok {
+		if norm_form, ok := r.normalForm(tag); ok {
 			if _, ok := tagMap[norm_form]; ok {
 				continue
 			} else {
@@ -206,3 +421,95 @@ type taginfo_title_sorter []*taginfo
 func (s taginfo_title_sorter) Len() int           { return len(s) }
 func (s taginfo_title_sorter) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s taginfo_title_sorter) Less(i, j int) bool { return s[i].title < s[j].title }
+
+// The tags whose indexing result may differ between the two rules.
+// Only normalization is compared if aliases is false.
+// Tags affected by changed NormalizationPatterns can't be listed here, see samePatterns.
+func (r *rule) changedTags(other *rule, aliases bool) []string {
+	changed := make(map[string]bool)
+	for tag, form := range r.norm_map {
+		if other.norm_map[tag] != form {
+			changed[tag] = true
+		}
+	}
+	for tag := range other.norm_map {
+		if _, ok := r.norm_map[tag]; !ok {
+			changed[tag] = true
+		}
+	}
+	if aliases {
+		diffStringsMap(r.entg_map, other.entg_map, changed)
+		for tag, weight := range r.entg_weights {
+			if other.entg_weights[tag] != weight {
+				changed[tag] = true
+			}
+		}
+		diffWeightsMap(r.contain_weights, other.contain_weights, changed)
+	}
+
+	ret := make([]string, 0, len(changed))
+	for tag := range changed {
+		ret = append(ret, tag)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func diffStringsMap(a, b map[string][]string, changed map[string]bool) {
+	for tag, as := range a {
+		bs, ok := b[tag]
+		if !ok || len(as) != len(bs) {
+			changed[tag] = true
+			continue
+		}
+		// the order of the expanded uppers is not stable, compare them as sets.
+		as, bs = append([]string(nil), as...), append([]string(nil), bs...)
+		sort.Strings(as)
+		sort.Strings(bs)
+		for i := range as {
+			if as[i] != bs[i] {
+				changed[tag] = true
+				break
+			}
+		}
+	}
+	for tag := range b {
+		if _, ok := a[tag]; !ok {
+			changed[tag] = true
+		}
+	}
+}
+
+func diffWeightsMap(a, b map[string]map[string]float64, changed map[string]bool) {
+	for tag, aw := range a {
+		bw, ok := b[tag]
+		if !ok || len(aw) != len(bw) {
+			changed[tag] = true
+			continue
+		}
+		for upper, weight := range aw {
+			if w, ok := bw[upper]; !ok || w != weight {
+				changed[tag] = true
+				break
+			}
+		}
+	}
+	for tag := range b {
+		if _, ok := a[tag]; !ok {
+			changed[tag] = true
+		}
+	}
+}
+
+func (r *rule) samePatterns(other *rule) bool {
+	if len(r.norm_patterns) != len(other.norm_patterns) {
+		return false
+	}
+	for i, p := range r.norm_patterns {
+		q := other.norm_patterns[i]
+		if p.prefix != q.prefix || p.suffix != q.suffix || p.replace != q.replace || (p.re == nil) != (q.re == nil) || (p.re != nil && p.re.String() != q.re.String()) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,187 @@
+package tagstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Load a rule from a .json / .yaml / .yml file, the keys are the same as the Rule fields in both formats.
+func LoadRuleFile(path string) (*Rule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Rule{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, r)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, r)
+	default:
+		err = fmt.Errorf("unknown rule file type")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("rule file %s: %v", path, err)
+	}
+	return r, nil
+}
+
+// Load a rule split across several files, they're merged in order.
+func LoadRuleFiles(paths ...string) (*Rule, error) {
+	r := &Rule{}
+	for _, path := range paths {
+		part, err := LoadRuleFile(path)
+		if err != nil {
+			return nil, err
+		}
+		r.Merge(part)
+	}
+	return r, nil
+}
+
+// Load all the rule files in a directory, in the order of the file names.
+// A directory without any rule file is an error, not an empty rule: it's rather a deployment in progress.
+func LoadRuleDir(dir string) (*Rule, error) {
+	paths, err := ruleFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("rule dir %s: no rule file", dir)
+	}
+	return LoadRuleFiles(paths...)
+}
+
+// Merge another rule into this one:
+// normal forms & containers are joined, entanglement groups are appended, weights of the other rule win.
+func (r *Rule) Merge(other *Rule) {
+	if len(other.Normalization) != 0 && r.Normalization == nil {
+		r.Normalization = make(map[string][]string)
+	}
+	for normal_form, unnormals := range other.Normalization {
+		r.Normalization[normal_form] = uniqueStrings(append(r.Normalization[normal_form], unnormals...))
+	}
+
+	r.NormalizationPatterns = append(r.NormalizationPatterns, other.NormalizationPatterns...)
+
+	// keep the group weights lined up with the groups.
+	if len(other.EntanglementWeights) != 0 {
+		for len(r.EntanglementWeights) < len(r.Entanglement) {
+			r.EntanglementWeights = append(r.EntanglementWeights, 0)
+		}
+		r.EntanglementWeights = append(r.EntanglementWeights, other.EntanglementWeights...)
+	}
+	r.Entanglement = append(r.Entanglement, other.Entanglement...)
+
+	if len(other.Containing) != 0 && r.Containing == nil {
+		r.Containing = make(map[string][]string)
+	}
+	for upper, lowers := range other.Containing {
+		r.Containing[upper] = uniqueStrings(append(r.Containing[upper], lowers...))
+	}
+
+	if len(other.ContainingWeights) != 0 && r.ContainingWeights == nil {
+		r.ContainingWeights = make(map[string]map[string]float64)
+	}
+	for upper, weights := range other.ContainingWeights {
+		if r.ContainingWeights[upper] == nil {
+			r.ContainingWeights[upper] = make(map[string]float64)
+		}
+		for lower, weight := range weights {
+			r.ContainingWeights[upper][lower] = weight
+		}
+	}
+
+	// the later files win.
+	if other.ContainingWeight != 0 {
+		r.ContainingWeight = other.ContainingWeight
+	}
+	if other.EntanglementWeight != 0 {
+		r.EntanglementWeight = other.EntanglementWeight
+	}
+	if other.ContainingDecay != 0 {
+		r.ContainingDecay = other.ContainingDecay
+	}
+}
+
+// Watch a rule directory, and SetRule when any of the rule files changes.
+// A rule that fails to load or to validate is logged and skipped, the index keeps the running rule,
+// so does a directory left without any rule file. Call the returned function to stop watching.
+func (index *Index) WatchRuleDir(dir string, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		index.logger().Panicln("WatchRuleDir: interval <= 0.")
+	}
+	chStop := make(chan bool)
+	last := ruleDirStamp(dir)
+
+	go func() {
+		for {
+			select {
+			case <-chStop:
+				return
+			case <-time.After(interval):
+			}
+
+			stamp := ruleDirStamp(dir)
+			if stamp == last {
+				continue
+			}
+			last = stamp
+
+			r, err := LoadRuleDir(dir)
+			if err != nil {
+				index.logger().Println("Rule reloading failed:", index.What, err)
+				continue
+			}
+			if diags := index.SetRule(r); len(diags) != 0 {
+				index.logger().Println("Rule reloading refused:", index.What, diags)
+				continue
+			}
+			index.logger().Println("Rule reloaded:", index.What, dir)
+		}
+	}()
+
+	return func() { close(chStop) }
+}
+
+func ruleFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(info.Name())) {
+		case ".json", ".yaml", ".yml":
+			paths = append(paths, filepath.Join(dir, info.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// the names, sizes & modify times of the rule files, changes if any of them changes.
+func ruleDirStamp(dir string) string {
+	paths, err := ruleFiles(dir)
+	if err != nil {
+		return ""
+	}
+	stamp := make([]string, 0, len(paths))
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			stamp = append(stamp, fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano()))
+		}
+	}
+	return strings.Join(stamp, "|")
+}
@@ -0,0 +1,55 @@
+package tagstack
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadRuleDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tagstack")
+	must(err == nil, "TempDir:", err)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "1.json"), []byte(`{
+		"Normalization": {"美食": ["吃", "好吃"]},
+		"Containing": {"美食": ["小吃"]}
+	}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "2.yaml"), []byte(`
+Normalization:
+  美食: [好吃, 美味]
+Entanglement:
+  - [南锣, 南锣鼓巷]
+Containing:
+  美食: [甜点]
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a rule"), 0644)
+
+	r, err := LoadRuleDir(dir)
+	must(err == nil, "LoadRuleDir:", err)
+	must(len(r.Normalization["美食"]) == 3, "Normalization:", r.Normalization)
+	must(len(r.Entanglement) == 1 && r.Entanglement[0][1] == "南锣鼓巷", "Entanglement:", r.Entanglement)
+	must(len(r.Containing["美食"]) == 2, "Containing:", r.Containing)
+
+	empty, err := ioutil.TempDir("", "tagstack")
+	must(err == nil, "TempDir:", err)
+	defer os.RemoveAll(empty)
+	_, err = LoadRuleDir(empty)
+	must(err != nil, "LoadRuleDir: a dir without rule files loaded")
+
+	ioutil.WriteFile(filepath.Join(dir, "3.json"), []byte(`{"Normalization": `), 0644)
+	_, err = LoadRuleDir(dir)
+	must(err != nil, "LoadRuleDir: broken file loaded")
+}
+
+func TestWatchRuleDirInterval(t *testing.T) {
+	index := &Index{Logger: log.New(ioutil.Discard, "", 0)}
+	panicked := func() (panicked bool) {
+		defer func() { panicked = recover() != nil }()
+		index.WatchRuleDir(os.TempDir(), 0)
+		return
+	}()
+	must(panicked, "WatchRuleDir: interval 0 accepted")
+}
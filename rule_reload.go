@@ -0,0 +1,86 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// Replace the rule of a running index.
+// The new rule is validated first, an invalid rule is refused and the diagnostics are returned.
+// Only the items under the tags whose normalization / containing / entanglement changed are reindexed,
+// and with RULE_EXPANSION_SEARCHING, only normalization changes need reindexing.
+func (index *Index) SetRule(r *Rule) (diags []RuleDiagnostic) {
+	if r == nil {
+		r = &Rule{}
+	}
+	if diags = r.Validate(); len(diags) != 0 {
+		return
+	}
+	next := index.initRule(r)
+
+	index.ruleLock.Lock()
+	last := index.rule
+	index.rule = next
+	index.Rule = r
+	index.ruleLock.Unlock()
+
+	// aliases are not in the index under RULE_EXPANSION_SEARCHING.
+	changed := last.changedTags(next, index.RuleExpansion != RULE_EXPANSION_SEARCHING)
+	if !last.samePatterns(next) {
+		changed = append(changed, index.patternChangedTags(last, next)...)
+	}
+	index.logger().Println("Rule changed:", index.What, "tags:", changed)
+
+	// the items were indexed under the tags themselves, or under their last normal forms.
+	affected := make(map[uint64]bool)
+	for _, tag := range changed {
+		for _, t := range uniqueStrings([]string{tag, last.normalize(tag)}) {
+			n := newIndexNode(index, []string{t}, 1.0)
+			for _, id := range n.items() {
+				affected[id] = true
+			}
+		}
+	}
+
+	index.logger().Println("Rule changed:", index.What, "reindexing items:", len(affected))
+	for id := range affected {
+		index.Update(id)
+	}
+	return
+}
+
+// The indexed tags normalized differently by the two rules' patterns.
+// The tag dictionary gives the indexed tags, and their display forms give the originals normalized away.
+func (idx *Index) patternChangedTags(last, next *rule) (changed []string) {
+	c := idx.primaryConn(idx.tagDictShard())
+	tags, _ := redis.Strings(idx.ast2(c.Do("ZRANGEBYLEX", idx.tagDictKey(const_key_tag_dict_lex), "-", "+")))
+	c.Close()
+
+	for _, tag := range tags {
+		n := newIndexNode(idx, []string{tag}, 1.0)
+		c := idx.primaryConn(n.shard)
+		originals, _ := redis.Strings(idx.ast2(c.Do("ZRANGE", n.idstr(const_key_tag_display_rank), 0, -1)))
+		c.Close()
+
+		for _, original := range append([]string{tag}, originals...) {
+			original = idx.normalizeTag(original)
+			if last.normalize(original) != next.normalize(original) {
+				changed = append(changed, tag)
+				break
+			}
+		}
+	}
+	return
+}
+
+// compile the rule, with the expanded containing on the index's debug logger.
+func (idx *Index) initRule(r *Rule) *rule {
+	ret := r.init()
+	idx.debugLogger().Printf("contain_map: %+v, contain_weights: %+v", ret.contain_map, ret.contain_weights)
+	return ret
+}
+
+func (idx *Index) currentRule() *rule {
+	idx.ruleLock.RLock()
+	defer idx.ruleLock.RUnlock()
+	return idx.rule
+}
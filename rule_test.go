@@ -3,6 +3,7 @@ package tagstack
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -39,3 +40,117 @@ func Test2(t *testing.T) {
 	must(err == nil, "json marshal rule :", err)
 	fmt.Println(string(x))
 }
+
+func TestValidate(t *testing.T) {
+	diags := dummyRule().Validate()
+	must(len(diags) == 0, "dummy rule:", diags)
+
+	rt := dummyRule()
+	rt.Normalization["餐饮"] = []string{"吃"}
+	rt.Containing["好吃"] = []string{"小吃"}
+	rt.Containing["马卡龙"] = []string{"美食"}
+	rt.Entanglement = append(rt.Entanglement, []string{"酒店", "宾馆"})
+
+	diags = rt.Validate()
+	must(len(diags) == 4, "diags:", diags)
+	must(diags[0].Problem == RULE_PROBLEM_NORMALIZATION_CONFLICT && diags[0].Tags[0] == "吃", "diags[0]:", diags[0])
+	must(diags[1].Problem == RULE_PROBLEM_NORMALIZED_CONTAINER && diags[1].Tags[0] == "好吃", "diags[1]:", diags[1])
+	must(diags[2].Problem == RULE_PROBLEM_ENTANGLEMENT_OVERLAP && diags[2].Tags[0] == "酒店", "diags[2]:", diags[2])
+	must(diags[3].Problem == RULE_PROBLEM_CONTAINING_CYCLE && len(diags[3].Tags) == 4, "diags[3]:", diags[3])
+	fmt.Println(diags)
+}
+
+func TestChangedTags(t *testing.T) {
+	last := dummyRule().init()
+	must(len(last.changedTags(dummyRule().init(), true)) == 0, "same rule changed")
+
+	rt := dummyRule()
+	rt.Normalization["住宿"] = []string{"住", "住店"}
+	rt.Containing["西餐"] = []string{"马卡龙", "牛排"}
+	changed := last.changedTags(rt.init(), true)
+	must(len(changed) == 2 && changed[0] == "住店" && changed[1] == "烤肉", "changed:", changed)
+}
+
+func TestWeights(t *testing.T) {
+	rt := dummyRule()
+	rt.ContainingWeights = map[string]map[string]float64{"西餐": {"马卡龙": 0.9}}
+	rt.EntanglementWeights = []float64{0.5}
+	rt.ContainingDecay = 0.5
+	must(len(rt.Validate()) == 0, "Validate:", rt.Validate())
+
+	r := rt.init()
+	must(r.contain_weights["马卡龙"]["西餐"] == 0.9 && r.contain_weights["马卡龙"]["美食"] == 0.4, "contain_weights:", r.contain_weights["马卡龙"])
+	must(r.entg_weights["酒店"] == 0.5 && r.entg_weights["骑车"] == 0.6, "entg_weights:", r.entg_weights)
+
+	infos := r.applyRulesForIndexing([]*taginfo{&taginfo{title: "马卡龙"}, &taginfo{title: "骑行"}})
+	must(len(infos) == 2, "infos:", infos)
+	for _, info := range infos {
+		must(len(info.aliases) == len(info.alias_scores), "aliases & scores:", info.aliases, info.alias_scores)
+	}
+
+	rt.ContainingWeights["西餐"]["牛肉"] = 1.5
+	must(len(rt.Validate()) == 2, "Validate:", rt.Validate())
+}
+
+func TestExpandForSearching(t *testing.T) {
+	r := dummyRule().init()
+	e := r.expandForSearching("美食")
+	must(len(e) == 7 && e["美食"] == 1.0 && e["马卡龙"] == 0.8, "expandForSearching:", e)
+	e = r.expandForSearching("自行车")
+	must(len(e) == 3 && e["自行车"] == 1.0 && e["骑行"] == 0.6, "expandForSearching:", e)
+	e = r.expandForSearching("A")
+	must(len(e) == 1, "expandForSearching:", e)
+}
+
+func TestNormalizationPatterns(t *testing.T) {
+	rt := dummyRule()
+	rt.NormalizationPatterns = []NormalizationPattern{
+		{Suffix: "市"},
+		{Prefix: "#"},
+		{Regexp: `^(.+?)[0-9]+$`, Replace: "$1"},
+		{Suffix: "吃吃", Replace: "吃"},
+	}
+	must(len(rt.Validate()) == 0, "Validate:", rt.Validate())
+
+	r := rt.init()
+	must(r.normalize("北京市") == "北京", "normalize:", r.normalize("北京市"))
+	must(r.normalize("市") == "市", "normalize:", r.normalize("市"))
+	must(r.normalize("#骑行") == "骑行", "normalize:", r.normalize("#骑行"))
+	must(r.normalize("客栈2") == "客栈", "normalize:", r.normalize("客栈2"))
+	must(r.normalize("好吃吃") == "美食", "normalize:", r.normalize("好吃吃"))
+	p, _ := NormalizationPattern{Regexp: "[0-9]+"}.compile()
+	_, ok := p.apply("123")
+	must(!ok, "apply: replaced by nothing")
+
+	tags := r.applyRulesForSearching([]string{"北京市", "北京"})
+	must(len(tags) == 1 && tags[0] == "北京", "applyRulesForSearching:", tags)
+
+	infos := r.applyRulesForIndexing([]*taginfo{&taginfo{title: "客栈2"}, &taginfo{title: "客栈"}})
+	must(len(infos) == 1 && infos[0].title == "客栈", "applyRulesForIndexing:", infos)
+	infos = r.applyRulesForIndexing([]*taginfo{&taginfo{title: "北京市", display: "北京市"}})
+	must(len(infos) == 1 && infos[0].title == "北京" && infos[0].display == "北京市", "applyRulesForIndexing:", infos[0])
+
+	rt.NormalizationPatterns = append(rt.NormalizationPatterns, NormalizationPattern{Regexp: "("}, NormalizationPattern{Prefix: "a", Suffix: "b"},
+		NormalizationPattern{Regexp: "^[0-9]+$"})
+	diags := rt.Validate()
+	must(len(diags) == 3 && diags[0].Problem == RULE_PROBLEM_INVALID_PATTERN && diags[2].Problem == RULE_PROBLEM_INVALID_PATTERN, "Validate:", diags)
+	// the invalid patterns are skipped.
+	must(r.samePatterns(rt.init()), "samePatterns")
+	rt.NormalizationPatterns = append(rt.NormalizationPatterns, NormalizationPattern{Suffix: "店"})
+	must(!r.samePatterns(rt.init()), "samePatterns")
+}
+
+func TestExplain(t *testing.T) {
+	e := dummyRule().Explain([]string{"好吃", "马卡龙", "住", "酒店"})
+	fmt.Println(e)
+	must(len(e.Indexed) == 2 && e.Indexed[0].Title == "马卡龙" && e.Indexed[1].Title == "住宿", "Indexed:", e.Indexed)
+	must(len(e.Searched) == 4, "Searched:", e.Searched)
+
+	disabled := 0
+	for _, step := range e.Steps {
+		if strings.HasPrefix(step.Detail, "disabled") {
+			disabled++
+		}
+	}
+	must(disabled == 2, "Steps:", e.Steps)
+}
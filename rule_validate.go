@@ -0,0 +1,236 @@
+package tagstack
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// problems a Rule may have.
+type RULE_PROBLEM int
+
+const (
+	// Containing goes round: A contains B, B contains ... contains A.
+	RULE_PROBLEM_CONTAINING_CYCLE = iota
+	// A tag is normalized to more than one normal form.
+	RULE_PROBLEM_NORMALIZATION_CONFLICT
+	// A tag is normalized away, but still used as a container, which never matches.
+	RULE_PROBLEM_NORMALIZED_CONTAINER
+	// A tag appears in more than one Entanglement group, only the last group takes effect.
+	RULE_PROBLEM_ENTANGLEMENT_OVERLAP
+	// A weight out of [0, 1], or a weight for an edge / group that doesn't exist.
+	RULE_PROBLEM_INVALID_WEIGHT
+	// A NormalizationPattern that doesn't compile.
+	RULE_PROBLEM_INVALID_PATTERN
+)
+
+// A problem found in a Rule, and the tags involved.
+type RuleDiagnostic struct {
+	Problem RULE_PROBLEM
+	Tags    []string
+	Detail  string
+}
+
+func (d RuleDiagnostic) String() string {
+	return d.Detail
+}
+
+// Check the rule, nothing returned means the rule is valid.
+// The diagnostics are in a stable order.
+func (r *Rule) Validate() (diags []RuleDiagnostic) {
+	// normalization conflicts.
+	norm_forms := make(map[string][]string)
+	for _, normal_form := range sortedKeys(r.Normalization) {
+		for _, unnormal_form := range r.Normalization[normal_form] {
+			norm_forms[unnormal_form] = append(norm_forms[unnormal_form], normal_form)
+		}
+	}
+	for _, unnormal_form := range sortedKeys(norm_forms) {
+		if forms := uniqueStrings(norm_forms[unnormal_form]); len(forms) > 1 {
+			diags = append(diags, RuleDiagnostic{
+				Problem: RULE_PROBLEM_NORMALIZATION_CONFLICT,
+				Tags:    append([]string{unnormal_form}, forms...),
+				Detail:  fmt.Sprintf("%q is normalized to more than one form: %s", unnormal_form, strings.Join(forms, ", ")),
+			})
+		}
+	}
+
+	// normalized containers.
+	for _, upper := range sortedKeys(r.Containing) {
+		if forms, ok := norm_forms[upper]; ok {
+			diags = append(diags, RuleDiagnostic{
+				Problem: RULE_PROBLEM_NORMALIZED_CONTAINER,
+				Tags:    []string{upper, forms[0]},
+				Detail:  fmt.Sprintf("%q is a container, but it's normalized to %q", upper, forms[0]),
+			})
+		}
+	}
+
+	// entanglement overlaps.
+	groups := make(map[string][]int)
+	overlaps := make([]string, 0)
+	for i, group := range r.Entanglement {
+		for _, tag := range uniqueStrings(group) {
+			groups[tag] = append(groups[tag], i)
+			if len(groups[tag]) == 2 {
+				overlaps = append(overlaps, tag)
+			}
+		}
+	}
+	sort.Strings(overlaps)
+	for _, tag := range overlaps {
+		diags = append(diags, RuleDiagnostic{
+			Problem: RULE_PROBLEM_ENTANGLEMENT_OVERLAP,
+			Tags:    []string{tag},
+			Detail:  fmt.Sprintf("%q is in more than one entanglement group: %v", tag, groups[tag]),
+		})
+	}
+
+	// weights.
+	for _, w := range []struct {
+		name   string
+		weight float64
+	}{{"ContainingWeight", r.ContainingWeight}, {"EntanglementWeight", r.EntanglementWeight}, {"ContainingDecay", r.ContainingDecay}} {
+		if w.weight < 0 || w.weight > 1 {
+			diags = append(diags, RuleDiagnostic{
+				Problem: RULE_PROBLEM_INVALID_WEIGHT,
+				Detail:  fmt.Sprintf("%s %v is out of [0, 1]", w.name, w.weight),
+			})
+		}
+	}
+	uppers := make([]string, 0, len(r.ContainingWeights))
+	for upper := range r.ContainingWeights {
+		uppers = append(uppers, upper)
+	}
+	sort.Strings(uppers)
+	for _, upper := range uppers {
+		lowers := make([]string, 0, len(r.ContainingWeights[upper]))
+		for lower := range r.ContainingWeights[upper] {
+			lowers = append(lowers, lower)
+		}
+		sort.Strings(lowers)
+		for _, lower := range lowers {
+			weight := r.ContainingWeights[upper][lower]
+			if weight < 0 || weight > 1 {
+				diags = append(diags, RuleDiagnostic{
+					Problem: RULE_PROBLEM_INVALID_WEIGHT,
+					Tags:    []string{upper, lower},
+					Detail:  fmt.Sprintf("containing weight %q > %q %v is out of [0, 1]", upper, lower, weight),
+				})
+			}
+			found := false
+			for _, l := range r.Containing[upper] {
+				if l == lower {
+					found = true
+					break
+				}
+			}
+			if !found {
+				diags = append(diags, RuleDiagnostic{
+					Problem: RULE_PROBLEM_INVALID_WEIGHT,
+					Tags:    []string{upper, lower},
+					Detail:  fmt.Sprintf("containing weight for %q > %q, but there's no such containing", upper, lower),
+				})
+			}
+		}
+	}
+	if len(r.EntanglementWeights) > len(r.Entanglement) {
+		diags = append(diags, RuleDiagnostic{
+			Problem: RULE_PROBLEM_INVALID_WEIGHT,
+			Detail:  fmt.Sprintf("%d entanglement weights for %d groups", len(r.EntanglementWeights), len(r.Entanglement)),
+		})
+	}
+	for i, weight := range r.EntanglementWeights {
+		if weight < 0 || weight > 1 {
+			diags = append(diags, RuleDiagnostic{
+				Problem: RULE_PROBLEM_INVALID_WEIGHT,
+				Detail:  fmt.Sprintf("entanglement weight of group %d %v is out of [0, 1]", i, weight),
+			})
+		}
+	}
+
+	// patterns.
+	for _, pattern := range r.NormalizationPatterns {
+		if _, err := pattern.compile(); err != nil {
+			diags = append(diags, RuleDiagnostic{
+				Problem: RULE_PROBLEM_INVALID_PATTERN,
+				Detail:  err.Error(),
+			})
+		}
+	}
+
+	// containing cycles.
+	for _, cycle := range containingCycles(r.Containing) {
+		diags = append(diags, RuleDiagnostic{
+			Problem: RULE_PROBLEM_CONTAINING_CYCLE,
+			Tags:    cycle,
+			Detail:  "containing cycle: " + strings.Join(cycle, " > "),
+		})
+	}
+
+	return
+}
+
+// find the cycles by dfs, each cycle is reported once, starting & ending with the same tag.
+func containingCycles(containing map[string][]string) (cycles [][]string) {
+	const (
+		white = iota
+		grey
+		black
+	)
+	color := make(map[string]int)
+	path := make([]string, 0, 10)
+
+	var visit func(tag string)
+	visit = func(tag string) {
+		color[tag] = grey
+		path = append(path, tag)
+		lowers := uniqueStrings(containing[tag])
+		sort.Strings(lowers)
+		for _, lower := range lowers {
+			switch color[lower] {
+			case white:
+				visit(lower)
+			case grey:
+				for i := len(path) - 1; i >= 0; i-- {
+					if path[i] == lower {
+						cycle := make([]string, len(path)-i, len(path)-i+1)
+						copy(cycle, path[i:])
+						cycles = append(cycles, append(cycle, lower))
+						break
+					}
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		color[tag] = black
+	}
+
+	for _, upper := range sortedKeys(containing) {
+		if color[upper] == white {
+			visit(upper)
+		}
+	}
+	return
+}
+
+func sortedKeys(m map[string][]string) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func uniqueStrings(strs []string) []string {
+	ret := make([]string, 0, len(strs))
+	seen := make(map[string]bool, len(strs))
+	for _, s := range strs {
+		if !seen[s] {
+			seen[s] = true
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
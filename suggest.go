@@ -0,0 +1,232 @@
+package tagstack
+
+import (
+	"github.com/garyburd/redigo/redis"
+	"sort"
+)
+
+// Options of SuggestRules, the zero values mean the defaults.
+type RuleSuggestOptions struct {
+	// Only the most popular tags are analyzed. Default: 1000
+	MaxTags int
+	// Tags with fewer items are ignored. Default: 5
+	MinCount int
+	// Entanglement: |A∩B| / |A∪B| at least. Default: 0.9
+	EntanglementRatio float64
+	// Containing B > A: |A∩B| / |A| at least, and B has more items than A. Default: 0.95
+	ContainingRatio float64
+	// Normalization: the max edit distance between the folded tags, tags shorter than 3 characters only match
+	// when folded or romanized equally. Default: 1
+	NormalizationDistance int
+}
+
+func (o *RuleSuggestOptions) defaults() *RuleSuggestOptions {
+	ret := &RuleSuggestOptions{MaxTags: 1000, MinCount: 5, EntanglementRatio: 0.9, ContainingRatio: 0.95, NormalizationDistance: 1}
+	if o == nil {
+		return ret
+	}
+	if o.MaxTags > 0 {
+		ret.MaxTags = o.MaxTags
+	}
+	if o.MinCount > 0 {
+		ret.MinCount = o.MinCount
+	}
+	if o.EntanglementRatio > 0 {
+		ret.EntanglementRatio = o.EntanglementRatio
+	}
+	if o.ContainingRatio > 0 {
+		ret.ContainingRatio = o.ContainingRatio
+	}
+	if o.NormalizationDistance > 0 {
+		ret.NormalizationDistance = o.NormalizationDistance
+	}
+	return ret
+}
+
+// Mine the index for rules worth adding: tags that nearly always go together (Entanglement), tags whose items are
+// almost a subset of another's (Containing), and tags spelled nearly the same (Normalization).
+// The returned rule only has the suggestions not in the running rule yet, for a human to review.
+// This reads the whole tag dictionary, it's meant to be run offline.
+func (index *Index) SuggestRules(options *RuleSuggestOptions) *Rule {
+	options = options.defaults()
+
+	// the most popular tags.
+	c := index.primaryConn(index.tagDictShard())
+	vals, _ := redis.Values(index.ast2(c.Do("ZREVRANGE", index.tagDictKey(const_key_tag_dict_count), 0, options.MaxTags-1, "WITHSCORES")))
+	c.Close()
+	counts := make(map[string]int, len(vals)/2)
+	for i := 0; i < len(vals); i += 2 {
+		tag, _ := redis.String(vals[i], nil)
+		count, _ := redis.Int(vals[i+1], nil)
+		if count >= options.MinCount {
+			counts[tag] = count
+		}
+	}
+
+	// co-occurrence: the relative tag ranks of the high tags, the items' own tags for the others.
+	co := make(map[string]map[string]int, len(counts))
+	for tag := range counts {
+		n := newIndexNode(index, []string{tag}, 1.0)
+		if n.isHigh() {
+			co[tag] = n.relativeTagCounts(counts)
+		} else {
+			co[tag] = index.cooccurrence(n, counts)
+		}
+	}
+
+	return suggestRules(counts, co, index.currentRule(), options)
+}
+
+func suggestRules(counts map[string]int, co map[string]map[string]int, existing *rule, options *RuleSuggestOptions) *Rule {
+	ret := &Rule{Normalization: make(map[string][]string), Containing: make(map[string][]string)}
+
+	tags := make([]string, 0, len(counts))
+	for tag := range counts {
+		tags = append(tags, tag)
+	}
+	// popular first, so the normal forms & the containers are the popular ones.
+	sort.Sort(&tagCountSorter{tags: tags, counts: tagCounts(tags, counts)})
+
+	// the spellings are compared pairwise, fold & romanize each tag once.
+	spellings := make([]*tagSpelling, len(tags))
+	for i, tag := range tags {
+		spellings[i] = newTagSpelling(tag)
+	}
+
+	normalized := make(map[string]bool)
+	// entangled tags are suggested as groups.
+	groups := make(map[string]int)
+	for i, a := range tags {
+		if normalized[a] {
+			continue
+		}
+		for j, b := range tags[i+1:] {
+			// a is at least as popular as b.
+			if normalized[b] || existing.related(a, b) {
+				continue
+			}
+
+			if similarTags(spellings[i], spellings[i+1+j], options.NormalizationDistance) {
+				ret.Normalization[a] = append(ret.Normalization[a], b)
+				normalized[b] = true
+				continue
+			}
+
+			both := co[a][b]
+			if co[b][a] > both {
+				both = co[b][a]
+			}
+			if both == 0 {
+				continue
+			}
+
+			if float64(both)/float64(counts[a]+counts[b]-both) >= options.EntanglementRatio {
+				if g, ok := groups[a]; ok {
+					if _, ok := groups[b]; !ok {
+						ret.Entanglement[g] = append(ret.Entanglement[g], b)
+						groups[b] = g
+					}
+				} else if _, ok := groups[b]; !ok {
+					groups[a], groups[b] = len(ret.Entanglement), len(ret.Entanglement)
+					ret.Entanglement = append(ret.Entanglement, []string{a, b})
+				}
+				continue
+			}
+
+			if counts[a] > counts[b] && float64(both)/float64(counts[b]) >= options.ContainingRatio {
+				ret.Containing[a] = append(ret.Containing[a], b)
+			}
+		}
+	}
+	return ret
+}
+
+// are the tags already related by the rule ?
+func (r *rule) related(a, b string) bool {
+	if r.normalize(a) == r.normalize(b) {
+		return true
+	}
+	for _, tag := range r.entg_map[a] {
+		if tag == b {
+			return true
+		}
+	}
+	for _, pair := range [][2]string{{a, b}, {b, a}} {
+		if _, ok := r.contain_weights[pair[0]][pair[1]]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// a tag's forms compared by similarTags.
+type tagSpelling struct {
+	folded []rune
+	// the full pinyin, "" if the tag can't be romanized.
+	romanized string
+}
+
+func newTagSpelling(tag string) *tagSpelling {
+	ret := &tagSpelling{folded: []rune(foldTag(tag))}
+	if r := romanize(tag); r != nil {
+		ret.romanized = r[0]
+	}
+	return ret
+}
+
+// nearly the same spelling: the same when folded or romanized, or within the edit distance for the longer tags.
+func similarTags(a, b *tagSpelling, distance int) bool {
+	if string(a.folded) == string(b.folded) {
+		return true
+	}
+	if a.romanized != "" && a.romanized == b.romanized {
+		return true
+	}
+	if len(a.folded) < 3 || len(b.folded) < 3 {
+		return false
+	}
+	return editDistance(a.folded, b.folded) <= distance
+}
+
+func tagCounts(tags []string, counts map[string]int) []int {
+	ret := make([]int, len(tags))
+	for i, tag := range tags {
+		ret[i] = counts[tag]
+	}
+	return ret
+}
+
+// the relative tags' item counts, only for the tags in the filter.
+func (node *index_node) relativeTagCounts(filter map[string]int) map[string]int {
+	c := node.idx.primaryConn(node.shard)
+	defer c.Close()
+	vals, _ := redis.Values(node.idx.ast2(c.Do("ZREVRANGE", node.idstr(const_key_idx_relative_rank), 0, -1, "WITHSCORES")))
+	ret := make(map[string]int)
+	for i := 0; i < len(vals); i += 2 {
+		tag, _ := redis.String(vals[i], nil)
+		count, _ := redis.Int(vals[i+1], nil)
+		if _, ok := filter[tag]; ok {
+			ret[tag] = count
+		}
+	}
+	return ret
+}
+
+// count the other tags of the node's items, only for the tags in the filter.
+func (idx *Index) cooccurrence(n *index_node, filter map[string]int) map[string]int {
+	ret := make(map[string]int)
+	for _, id := range n.items() {
+		item_tags := make(map[string]bool)
+		for _, info := range idx.itemTagInfos(id) {
+			for _, tag := range append([]string{info.title}, info.aliases...) {
+				if _, ok := filter[tag]; ok && tag != n.tags[0] {
+					item_tags[tag] = true
+				}
+			}
+		}
+		for tag := range item_tags {
+			ret[tag]++
+		}
+	}
+	return ret
+}
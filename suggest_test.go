@@ -0,0 +1,30 @@
+package tagstack
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestSuggestRules(t *testing.T) {
+	counts := map[string]int{"美食": 100, "小吃": 30, "南锣": 20, "南锣鼓巷": 19, "鼓浪屿": 50, "鼓浪与": 6, "Coffee": 10, "coffee": 8, "夜市": 25}
+	co := map[string]map[string]int{
+		"美食":   {"小吃": 29, "夜市": 10},
+		"南锣":   {"南锣鼓巷": 19},
+		"鼓浪屿":  {"美食": 5},
+		"夜市":   {"小吃": 5},
+		"小吃":   {"美食": 29},
+		"南锣鼓巷": {"南锣": 19},
+	}
+	r := suggestRules(counts, co, (&Rule{}).init(), (*RuleSuggestOptions)(nil).defaults())
+	x, _ := json.Marshal(r)
+	fmt.Println(string(x))
+
+	must(len(r.Entanglement) == 1 && r.Entanglement[0][0] == "南锣" && r.Entanglement[0][1] == "南锣鼓巷", "Entanglement:", r.Entanglement)
+	must(len(r.Containing) == 1 && len(r.Containing["美食"]) == 1 && r.Containing["美食"][0] == "小吃", "Containing:", r.Containing)
+	must(len(r.Normalization) == 2 && r.Normalization["Coffee"][0] == "coffee", "Normalization:", r.Normalization)
+
+	// known relations are not suggested again.
+	r = suggestRules(counts, co, dummyRule().init(), (*RuleSuggestOptions)(nil).defaults())
+	must(len(r.Entanglement) == 0 && len(r.Containing) == 0, "suggested again:", r)
+}
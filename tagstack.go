@@ -12,6 +12,7 @@ type GetRedisConnFuncType func(shard_key int) redis.Conn
 
 type HighTagNotifyFuncType func(tags []string)
 
+// The defaults of the Index settings of the same names, for the indexes leaving them zero.
 var (
 	// To get reading / writing connections, tagstack is based on Redis & redigo.
 	GetReadConn, GetWriteConn GetRedisConnFuncType
@@ -19,10 +20,25 @@ var (
 	// To notify if a new tag group becomes high.
 	HighTagNofityFunc HighTagNotifyFuncType
 
+	// To notify if a high tag group is demoted.
+	LowTagNotifyFunc HighTagNotifyFuncType
+
 	RedisShardMax int
+
+	// Optional: Run on Redis Cluster, the keys used together are hash tagged into one slot.
+	// GetReadConn / GetWriteConn should return the cluster aware connections then, the shard keys are ignored,
+	// and RedisShardMax & Router are not used.
+	RedisCluster bool
+
+	// For RedisCluster: the connections to all the masters, to scan the whole keyspace, eg: MigrateTagKeys.
+	GetMasterConns func() []redis.Conn
+
+	// Optional: Route the keys onto the shards with consistent hashing, see ShardRouter.
+	// nil means the raw checksums are passed to GetReadConn / GetWriteConn, and RedisShardMax is the count of the shards.
+	Router *ShardRouter
 )
 
-// Loggers.
+// Loggers, the defaults of Index.Logger & Index.DebugLogger.
 var (
 	// Normal logger.
 	Logger = log.New(os.Stdout, "[tagstack]", log.LstdFlags)